@@ -0,0 +1,104 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+)
+
+// encoder writes the primitive types of the binary serialization :
+// varints for integers and uvarint length prefixed bytes for strings
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeInt(i int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], i)
+	e.buf.Write(b[:n])
+}
+
+func (e *encoder) writeString(s string) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(s)))
+	e.buf.Write(b[:n])
+	e.buf.WriteString(s)
+}
+
+// writeHeader writes the number of keys then each key followed by its values
+func (e *encoder) writeHeader(header http.Header) {
+	e.writeInt(int64(len(header)))
+	for key, values := range header {
+		e.writeString(key)
+		e.writeInt(int64(len(values)))
+		for _, value := range values {
+			e.writeString(value)
+		}
+	}
+}
+
+// decoder reads what encoder writes, the first error is kept and returned by err()
+type decoder struct {
+	buf *bytes.Reader
+	e   error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{buf: bytes.NewReader(data)}
+}
+
+func (d *decoder) readInt() int64 {
+	if d.e != nil {
+		return 0
+	}
+	i, err := binary.ReadVarint(d.buf)
+	if err != nil {
+		d.e = fmt.Errorf("Unable to decode integer : %s", err)
+	}
+	return i
+}
+
+func (d *decoder) readString() string {
+	if d.e != nil {
+		return ""
+	}
+	size, err := binary.ReadUvarint(d.buf)
+	if err != nil {
+		d.e = fmt.Errorf("Unable to decode string length : %s", err)
+		return ""
+	}
+	if size > uint64(d.buf.Len()) {
+		d.e = fmt.Errorf("Truncated string")
+		return ""
+	}
+	b := make([]byte, size)
+	d.buf.Read(b)
+	return string(b)
+}
+
+func (d *decoder) readHeader() (header http.Header) {
+	header = make(http.Header)
+	keys := d.readInt()
+	for i := int64(0); i < keys && d.e == nil; i++ {
+		key := d.readString()
+		count := d.readInt()
+		if count < 0 || count > int64(d.buf.Len()) {
+			d.e = fmt.Errorf("Invalid header value count")
+			return
+		}
+		values := make([]string, 0, count)
+		for j := int64(0); j < count && d.e == nil; j++ {
+			values = append(values, d.readString())
+		}
+		header[key] = values
+	}
+	return
+}
+
+func (d *decoder) err() error {
+	if d.e == nil && d.buf.Len() != 0 {
+		return fmt.Errorf("Unexpected trailing bytes")
+	}
+	return d.e
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that can be set from a JSON file,
+// a flag or an environment variable using the "10s" notation
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	return d.Set(value)
+}
+
+// StringList is a list of strings that can be set from a flag
+// or an environment variable using a comma separated value
+type StringList []string
+
+func (sl StringList) String() string {
+	return strings.Join(sl, ",")
+}
+
+// Contains returns true if value is in the list
+func (sl StringList) Contains(value string) bool {
+	for _, s := range sl {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the whole list so that flags override the configuration file
+func (sl *StringList) Set(value string) error {
+	list := make(StringList, 0)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	*sl = list
+	return nil
+}
+
+// StringMap is a map of strings that can be set from a flag
+// or an environment variable using a "key=value,key=value" value
+type StringMap map[string]string
+
+func (sm StringMap) String() string {
+	keys := make([]string, 0, len(sm))
+	for key := range sm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(sm))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+sm[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set replaces the whole map so that flags override the configuration file
+func (sm *StringMap) Set(value string) error {
+	m := make(StringMap)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*sm = m
+	return nil
+}
+
+// LoadConfig fills config from, in increasing order of precedence, the JSON file
+// given by the "config" flag, the environment variables and the command line flags.
+//
+// Every flag registered in fs can be set by an environment variable named after
+// the flag name in upper case prefixed by envPrefix ( ex : ISOLATOR_READ_TIMEOUT ).
+func LoadConfig(config interface{}, fs *flag.FlagSet, args []string, envPrefix string) (err error) {
+	err = fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	path := ""
+	if f := fs.Lookup("config"); f != nil {
+		path = f.Value.String()
+	}
+	if path == "" {
+		path = os.Getenv(envPrefix + "_CONFIG")
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read configuration file : %s", err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+		if err != nil {
+			return fmt.Errorf("Unable to parse configuration file %s : %s", path, err)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+
+		name := envPrefix + "_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if e := f.Value.Set(value); e != nil {
+				err = fmt.Errorf("Invalid value %q for environment variable %s : %s", value, name, e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Parse the command line again so that flags take precedence
+	return fs.Parse(args)
+}
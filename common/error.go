@@ -0,0 +1,86 @@
+package common
+
+import (
+	"net/http"
+)
+
+// ErrorHeader tells the client why the proxy was not able to execute its request
+const ErrorHeader = "X-PROXY-ERROR"
+
+// Error classes
+const (
+	// The destination host name could not be resolved
+	ErrorDNS = "dns"
+	// The destination refused or did not accept the connection
+	ErrorConnect = "connect"
+	// The TLS handshake with the destination failed
+	ErrorTLS = "tls"
+	// The destination did not answer in time
+	ErrorTimeout = "timeout"
+	// The destination is not allowed by the proxy policy
+	ErrorPolicyDenied = "policy-denied"
+	// The request body could not be read
+	ErrorBodyRead = "body-read"
+	// The request can't be executed ( missing or invalid destination )
+	ErrorBadRequest = "bad-request"
+	// Anything else
+	ErrorUnknown = "unknown"
+)
+
+// ProxyError is sent by the proxy in a FrameError instead
+// of a response when it is unable to execute a request
+type ProxyError struct {
+	Class  string
+	Detail string
+}
+
+func NewProxyError(class string, detail string) (e *ProxyError) {
+	e = new(ProxyError)
+	e.Class = class
+	e.Detail = detail
+	return
+}
+
+func (e *ProxyError) Error() string {
+	return e.Class + " : " + e.Detail
+}
+
+// StatusCode returns the HTTP status code returned to the client for this class of error
+func (e *ProxyError) StatusCode() int {
+	switch e.Class {
+	case ErrorBadRequest:
+		return http.StatusBadRequest
+	case ErrorPolicyDenied:
+		return http.StatusForbidden
+	case ErrorTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorBodyRead:
+		return http.StatusBadGateway
+	case ErrorConnect:
+		// Web server is down
+		return 521
+	case ErrorDNS:
+		// Origin is unreachable
+		return 523
+	case ErrorTLS:
+		// SSL handshake failed
+		return 525
+	}
+	return 526
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (e *ProxyError) MarshalBinary() ([]byte, error) {
+	enc := new(encoder)
+	enc.writeString(e.Class)
+	enc.writeString(e.Detail)
+	return enc.buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (e *ProxyError) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	e.Class = d.readString()
+	e.Detail = d.readString()
+	return d.err()
+}
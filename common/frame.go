@@ -0,0 +1,113 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Wire protocol between the isolator and the proxies
+//
+// The proxy opens a websocket on the isolator /register endpoint and negotiates
+// the Subprotocol ( "isolator.v2" ). Every websocket message is then a binary
+// message carrying exactly one frame :
+//
+//	+---------+------+-------+-----------------------+-------------+
+//	| version | type | flags | stream id ( uint32 )  | payload ... |
+//	| 1 byte  | 1 B  | 1 B   | 4 bytes big endian    |             |
+//	+---------+------+-------+-----------------------+-------------+
+//
+// The first frame is a FrameGreeting on stream 0 sent by the proxy. Then the isolator
+// opens a stream for each request by sending a FrameRequest ( or a FrameTunnel for
+// CONNECT requests ) with a new stream id.
+// Each side sends its head frame ( FrameRequest / FrameResponse ) followed by
+// FrameData frames, the last frame of a direction carries FlagEnd ( it may be an empty
+// FrameData ). FrameWindow grants the peer more bytes of data ( flow control ) and
+// FrameReset aborts a stream. A proxy unable to execute a request answers with a
+// FrameError instead of a FrameResponse, then resets the stream. The isolator sends
+// a FrameCancel when the client goes away so that the proxy aborts the request.
+//
+// Peers must reject frames with an unknown version, unknown frame types are
+// ignored so that new types can be added without breaking older peers.
+
+// ProtocolVersion is the version of the framing and of the binary heads,
+// it must be bumped with the Subprotocol whenever their encoding changes.
+//
+//	1 : initial multiplexed protocol
+//	2 : timeouts and redirect flag in HttpRequest, TunnelRequest and register token nonce
+const ProtocolVersion = 2
+
+// Subprotocol is the websocket subprotocol negotiated during the upgrade,
+// peers speaking different versions refuse each other before any request
+const Subprotocol = "isolator.v2"
+
+// Frame types
+const (
+	// JSON serialized Greeting ( proxy -> isolator, stream 0 )
+	FrameGreeting byte = iota + 1
+	// Opens a stream with a binary serialized HttpRequest ( isolator -> proxy )
+	FrameRequest
+	// Binary serialized HttpResponse ( proxy -> isolator )
+	FrameResponse
+	// A chunk of body
+	FrameData
+	// The sender can send N more bytes of data ( uint32 payload )
+	FrameWindow
+	// Abort the stream
+	FrameReset
+	// Binary serialized ProxyError sent instead of a FrameResponse ( proxy -> isolator )
+	FrameError
+	// The client went away, abort the request ( isolator -> proxy )
+	FrameCancel
+	// Opens a stream with a binary serialized TunnelRequest ( isolator -> proxy ),
+	// the proxy answers with an empty FrameTunnel once connected or a FrameError
+	FrameTunnel
+)
+
+// Frame flags
+const (
+	// The sender will not send any more data on the stream
+	FlagEnd byte = 1 << iota
+)
+
+// Frame is the unit exchanged over the websocket, one per binary message
+type Frame struct {
+	Type     byte
+	Flags    byte
+	StreamID uint32
+	Payload  []byte
+}
+
+const frameHeaderSize = 7
+
+// Encode serializes the frame with the current protocol version
+func (f *Frame) Encode() (data []byte) {
+	data = make([]byte, frameHeaderSize+len(f.Payload))
+	data[0] = ProtocolVersion
+	data[1] = f.Type
+	data[2] = f.Flags
+	binary.BigEndian.PutUint32(data[3:7], f.StreamID)
+	copy(data[frameHeaderSize:], f.Payload)
+	return
+}
+
+// DecodeFrame unserializes a frame, it fails if the peer speaks another version
+func DecodeFrame(data []byte) (f *Frame, err error) {
+	if len(data) < frameHeaderSize {
+		return nil, fmt.Errorf("Frame too short ( %d bytes )", len(data))
+	}
+	if data[0] != ProtocolVersion {
+		return nil, fmt.Errorf("Incompatible peer, unsupported protocol version %d", data[0])
+	}
+
+	f = new(Frame)
+	f.Type = data[1]
+	f.Flags = data[2]
+	f.StreamID = binary.BigEndian.Uint32(data[3:7])
+	f.Payload = data[frameHeaderSize:]
+	return
+}
+
+// End returns true if this is the last frame of the sender direction
+func (f *Frame) End() bool {
+	return f.Flags&FlagEnd != 0
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// GreetingVersion is the version of the handshake sent by the proxies
+const GreetingVersion = 1
+
+// Greeting is the first frame a proxy sends on a new websocket connection,
+// it is JSON serialized so that fields can be added without a new protocol version
+type Greeting struct {
+	Version int
+
+	// Name of the pool to register in
+	Name string
+
+	// Unique id of the proxy process
+	InstanceID string
+
+	AgentVersion string
+
+	// Free form labels ( region, network zone, egress IP, ... ) used for routing
+	Labels map[string]string
+
+	// Features supported by the proxy
+	Capabilities []string
+
+	// Maximum number of concurrent requests the proxy can handle
+	Capacity int
+
+	// Maximum number of concurrent streams on each websocket connection
+	MaxStreams int
+}
+
+// WriteGreeting sends the greeting as the first frame of a new connection
+func WriteGreeting(ws *websocket.Conn, g *Greeting) error {
+	payload, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("Unable to serialize greeting : %s", err)
+	}
+
+	f := &Frame{Type: FrameGreeting, Payload: payload}
+	return ws.WriteMessage(websocket.BinaryMessage, f.Encode())
+}
+
+// ReadGreeting reads and validates the first frame of a new connection
+func ReadGreeting(ws *websocket.Conn) (g *Greeting, err error) {
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read greeting : %s", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		return nil, fmt.Errorf("Unexpected text message instead of greeting frame")
+	}
+
+	f, err := DecodeFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != FrameGreeting || f.StreamID != 0 {
+		return nil, fmt.Errorf("Unexpected frame type %d instead of greeting", f.Type)
+	}
+
+	g = new(Greeting)
+	err = json.Unmarshal(f.Payload, g)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unserialize greeting : %s", err)
+	}
+
+	if g.Name == "" {
+		return nil, fmt.Errorf("Missing name in greeting")
+	}
+	if g.Version > GreetingVersion {
+		return nil, fmt.Errorf("Unsupported greeting version %d", g.Version)
+	}
+	if g.Labels == nil {
+		g.Labels = make(map[string]string)
+	}
+
+	return
+}
+
+// HasCapability returns true if the proxy advertised the capability
+func (g *Greeting) HasCapability(capability string) bool {
+	for _, c := range g.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
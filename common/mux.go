@@ -0,0 +1,569 @@
+package common
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Number of bytes a stream can send before receiving a window update
+	InitialWindow = 256 * 1024
+
+	// Maximum payload of a frame, data is split and larger heads are rejected
+	MaxFrameSize = 32 * 1024
+
+	// Maximum duration of a websocket write, the session is closed if it expires
+	WriteTimeout = 30 * time.Second
+
+	// Number of control frames waiting for the writer goroutine
+	controlQueueSize = 256
+)
+
+var (
+	ErrSessionClosed  = errors.New("session closed")
+	ErrStreamReset    = errors.New("stream reset by peer")
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrStreamCanceled = errors.New("stream canceled")
+	ErrDeadPeer       = errors.New("peer did not answer the heartbeat")
+)
+
+// Session multiplexes many concurrent streams over a single websocket ( see frame.go ).
+//
+// Data is flow controlled per stream : a sender can only have InitialWindow
+// bytes in flight, the receiver grants more with FrameWindow as it consumes them.
+type Session struct {
+	ws    *websocket.Conn
+	wlock sync.Mutex
+
+	// Control frames ( window updates, resets ) are sent by a writer goroutine
+	// so that the reader never blocks on the websocket
+	control chan *Frame
+
+	// Called in a new goroutine for each stream opened by the peer
+	accept func(*Stream)
+
+	streams map[uint32]*Stream
+	nextID  uint32
+	lock    sync.Mutex
+
+	// Maximum duration without receiving anything from the peer, 0 = none
+	deadline int64
+
+	done chan struct{}
+	err  error
+}
+
+// NewSession starts reading frames from the websocket,
+// accept may be nil if the peer is not allowed to open streams
+func NewSession(ws *websocket.Conn, accept func(*Stream)) (s *Session) {
+	s = new(Session)
+	s.ws = ws
+	s.accept = accept
+	s.streams = make(map[uint32]*Stream)
+	s.done = make(chan struct{})
+	s.control = make(chan *Frame, controlQueueSize)
+
+	// The peer never sends more than a frame per message
+	ws.SetReadLimit(MaxFrameSize + frameHeaderSize)
+
+	// Pongs extend the read deadline once Heartbeat is enabled, the handler
+	// must be installed before the reader starts
+	ws.SetPongHandler(func(string) error {
+		s.extendDeadline()
+		return nil
+	})
+
+	go s.read()
+	go s.writeControl()
+
+	return
+}
+
+// Open starts a new stream
+func (s *Session) Open() (stream *Stream, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.nextID++
+	stream = newStream(s, s.nextID)
+	s.streams[stream.ID] = stream
+	return
+}
+
+// NumStreams returns the number of streams in progress
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.streams)
+}
+
+// Done is closed when the websocket is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session has been closed
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// Close closes the websocket, every stream is aborted
+func (s *Session) Close() error {
+	return s.ws.Close()
+}
+
+// Heartbeat pings the peer every interval, the session is closed with ErrDeadPeer
+// if nothing ( frame or pong ) is received from the peer for interval + timeout
+func (s *Session) Heartbeat(interval time.Duration, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	atomic.StoreInt64(&s.deadline, int64(interval+timeout))
+	s.extendDeadline()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				// The read deadline closes the session if the peer is really gone
+				s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+			}
+		}
+	}()
+}
+
+func (s *Session) extendDeadline() {
+	if deadline := atomic.LoadInt64(&s.deadline); deadline > 0 {
+		s.ws.SetReadDeadline(time.Now().Add(time.Duration(deadline)))
+	}
+}
+
+func (s *Session) write(f *Frame) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	s.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	err := s.ws.WriteMessage(websocket.BinaryMessage, f.Encode())
+	if err != nil {
+		// The websocket can't be written anymore, the reader shuts the session down
+		s.ws.Close()
+	}
+	return err
+}
+
+// writeAsync queues a control frame without blocking the caller
+func (s *Session) writeAsync(f *Frame) {
+	select {
+	case s.control <- f:
+	case <-s.done:
+	default:
+		// The queue is full, the frame must not be lost nor block the reader
+		go s.write(f)
+	}
+}
+
+func (s *Session) writeControl() {
+	for {
+		select {
+		case f := <-s.control:
+			s.write(f)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) read() {
+	var err error
+	defer func() {
+		s.shutdown(err)
+	}()
+
+	for {
+		var data []byte
+		_, data, err = s.ws.ReadMessage()
+		if err != nil {
+			if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				err = ErrDeadPeer
+			}
+			return
+		}
+		s.extendDeadline()
+
+		var f *Frame
+		f, err = DecodeFrame(data)
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		stream, ok := s.streams[f.StreamID]
+		if !ok && (f.Type == FrameRequest || f.Type == FrameTunnel) && s.accept != nil {
+			stream = newStream(s, f.StreamID)
+			s.streams[f.StreamID] = stream
+			go s.accept(stream)
+			ok = true
+		}
+		s.lock.Unlock()
+
+		if !ok {
+			// Late frame of a stream that has already been closed
+			if f.Type == FrameData || f.Type == FrameRequest || f.Type == FrameResponse || f.Type == FrameTunnel {
+				s.writeAsync(&Frame{Type: FrameReset, StreamID: f.StreamID})
+			}
+			continue
+		}
+
+		switch f.Type {
+		case FrameRequest, FrameResponse, FrameError, FrameTunnel:
+			stream.receiveHead(f)
+		case FrameData:
+			stream.receive(f.Payload)
+		case FrameWindow:
+			if len(f.Payload) != 4 {
+				log.Printf("Invalid window frame on stream %d", f.StreamID)
+				stream.Reset()
+				continue
+			}
+			stream.receiveWindow(int(binary.BigEndian.Uint32(f.Payload)))
+		case FrameReset:
+			stream.abort(ErrStreamReset)
+		case FrameCancel:
+			stream.abort(ErrStreamCanceled)
+		default:
+			// Unknown frame types are ignored for forward compatibility
+			continue
+		}
+
+		if f.End() {
+			stream.receiveEnd()
+		}
+	}
+}
+
+func (s *Session) shutdown(err error) {
+	s.ws.Close()
+
+	s.lock.Lock()
+	if err == nil || err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.abort(ErrSessionClosed)
+	}
+
+	close(s.done)
+}
+
+func (s *Session) remove(stream *Stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.streams, stream.ID)
+}
+
+// Stream is a bidirectional flow of frames inside a session
+type Stream struct {
+	ID      uint32
+	session *Session
+
+	heads chan *Frame
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	buffer     bytes.Buffer
+	recvWindow int
+	unacked    int
+	recvEnd    bool
+	discard    bool
+	sendWindow int
+	sendEnd    bool
+	err        error
+	done       chan struct{}
+}
+
+func newStream(session *Session, id uint32) (stream *Stream) {
+	stream = new(Stream)
+	stream.ID = id
+	stream.session = session
+	stream.heads = make(chan *Frame, 4)
+	stream.cond = sync.NewCond(&stream.lock)
+	stream.recvWindow = InitialWindow
+	stream.sendWindow = InitialWindow
+	stream.done = make(chan struct{})
+	return
+}
+
+// ReadFrame returns the next head frame sent by the peer
+func (stream *Stream) ReadFrame() (*Frame, error) {
+	select {
+	case f := <-stream.heads:
+		return f, nil
+	case <-stream.done:
+		select {
+		case f := <-stream.heads:
+			return f, nil
+		default:
+			return nil, stream.Err()
+		}
+	}
+}
+
+// WriteFrame sends a head frame to the peer
+func (stream *Stream) WriteFrame(frameType byte, payload []byte) error {
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("Frame too large : %d bytes, maximum is %d", len(payload), MaxFrameSize)
+	}
+	return stream.session.write(&Frame{Type: frameType, StreamID: stream.ID, Payload: payload})
+}
+
+// WriteHead serializes and sends a head frame to the peer
+func (stream *Stream) WriteHead(frameType byte, head encoding.BinaryMarshaler) error {
+	payload, err := head.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Unable to serialize frame : %s", err)
+	}
+	return stream.WriteFrame(frameType, payload)
+}
+
+// Read reads the data sent by the peer, it returns io.EOF once the peer has sent FlagEnd
+func (stream *Stream) Read(p []byte) (n int, err error) {
+	stream.lock.Lock()
+	for stream.buffer.Len() == 0 && !stream.recvEnd && stream.err == nil {
+		stream.cond.Wait()
+	}
+
+	if stream.buffer.Len() > 0 {
+		n, _ = stream.buffer.Read(p)
+		stream.unacked += n
+
+		// Grant the peer the consumed bytes once half of the window is used
+		grant := 0
+		if stream.unacked >= InitialWindow/2 && !stream.recvEnd {
+			grant = stream.unacked
+			stream.unacked = 0
+			stream.recvWindow += grant
+		}
+		stream.lock.Unlock()
+
+		if grant > 0 {
+			stream.sendWindowUpdate(grant)
+		}
+		return n, nil
+	}
+	defer stream.lock.Unlock()
+
+	if stream.recvEnd {
+		return 0, io.EOF
+	}
+	return 0, stream.err
+}
+
+// Write sends data to the peer, it blocks while the peer window is exhausted
+func (stream *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		stream.lock.Lock()
+		for stream.sendWindow == 0 && stream.err == nil && !stream.sendEnd {
+			stream.cond.Wait()
+		}
+		if stream.err != nil {
+			err = stream.err
+		} else if stream.sendEnd {
+			err = ErrStreamClosed
+		}
+		if err != nil {
+			stream.lock.Unlock()
+			return
+		}
+
+		size := len(p)
+		if size > stream.sendWindow {
+			size = stream.sendWindow
+		}
+		if size > MaxFrameSize {
+			size = MaxFrameSize
+		}
+		stream.sendWindow -= size
+		stream.lock.Unlock()
+
+		err = stream.session.write(&Frame{Type: FrameData, StreamID: stream.ID, Payload: p[:size]})
+		if err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// CloseWrite notifies the peer that no more data will be sent
+func (stream *Stream) CloseWrite() (err error) {
+	stream.lock.Lock()
+	if stream.sendEnd || stream.err != nil {
+		err = stream.err
+		stream.lock.Unlock()
+		return
+	}
+	stream.sendEnd = true
+	stream.cond.Broadcast()
+	finished := stream.recvEnd
+	stream.lock.Unlock()
+
+	err = stream.session.write(&Frame{Type: FrameData, Flags: FlagEnd, StreamID: stream.ID})
+	if finished {
+		stream.session.remove(stream)
+	}
+	return
+}
+
+// CloseRead discards the data not read yet, the peer is still granted
+// window updates so that it can finish sending its data
+func (stream *Stream) CloseRead() {
+	stream.lock.Lock()
+	stream.discard = true
+	grant := stream.unacked + stream.buffer.Len()
+	stream.unacked = 0
+	stream.buffer.Reset()
+	stream.recvWindow += grant
+	recvEnd := stream.recvEnd
+	stream.lock.Unlock()
+
+	if grant > 0 && !recvEnd {
+		stream.sendWindowUpdate(grant)
+	}
+}
+
+// Reset aborts the stream on both sides
+func (stream *Stream) Reset() {
+	if stream.abort(ErrStreamClosed) {
+		stream.session.writeAsync(&Frame{Type: FrameReset, StreamID: stream.ID})
+	}
+}
+
+// Cancel aborts the stream on both sides because the result is not needed anymore
+func (stream *Stream) Cancel() {
+	if stream.abort(ErrStreamCanceled) {
+		stream.session.writeAsync(&Frame{Type: FrameCancel, StreamID: stream.ID})
+	}
+}
+
+// Err returns the reason the stream has been aborted
+func (stream *Stream) Err() error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	return stream.err
+}
+
+// Done is closed when the stream is aborted
+func (stream *Stream) Done() <-chan struct{} {
+	return stream.done
+}
+
+func (stream *Stream) sendWindowUpdate(n int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(n))
+	stream.session.writeAsync(&Frame{Type: FrameWindow, StreamID: stream.ID, Payload: payload})
+}
+
+func (stream *Stream) abort(err error) bool {
+	stream.lock.Lock()
+	if stream.err != nil {
+		stream.lock.Unlock()
+		return false
+	}
+	stream.err = err
+	stream.cond.Broadcast()
+	close(stream.done)
+	stream.lock.Unlock()
+
+	stream.session.remove(stream)
+	return true
+}
+
+func (stream *Stream) receiveHead(f *Frame) {
+	select {
+	case stream.heads <- f:
+	default:
+		log.Printf("Too many unread frames on stream %d", stream.ID)
+		stream.Reset()
+	}
+}
+
+func (stream *Stream) receive(data []byte) {
+	stream.lock.Lock()
+	if stream.err != nil || stream.recvEnd {
+		stream.lock.Unlock()
+		return
+	}
+
+	if len(data) > stream.recvWindow {
+		stream.lock.Unlock()
+		log.Printf("Flow control violation on stream %d", stream.ID)
+		stream.Reset()
+		return
+	}
+
+	if stream.discard {
+		stream.lock.Unlock()
+		stream.sendWindowUpdate(len(data))
+		return
+	}
+
+	stream.recvWindow -= len(data)
+	stream.buffer.Write(data)
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+}
+
+func (stream *Stream) receiveEnd() {
+	stream.lock.Lock()
+	stream.recvEnd = true
+	stream.cond.Broadcast()
+	finished := stream.sendEnd
+	stream.lock.Unlock()
+
+	if finished {
+		stream.session.remove(stream)
+	}
+}
+
+func (stream *Stream) receiveWindow(n int) {
+	stream.lock.Lock()
+	stream.sendWindow += n
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+}
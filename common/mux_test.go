@@ -0,0 +1,218 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSessions returns both ends of a websocket, the streams opened
+// by the client are sent to the accepted channel once their head is received
+func newTestSessions(t *testing.T) (client *Session, server *Session, accepted chan *Stream) {
+	accepted = make(chan *Stream, 16)
+	servers := make(chan *Session, 1)
+
+	upgrader := websocket.Upgrader{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		servers <- NewSession(ws, func(stream *Stream) {
+			_, err := stream.ReadFrame()
+			if err == nil {
+				accepted <- stream
+			}
+		})
+	}))
+	t.Cleanup(httpServer.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unable to dial : %s", err)
+	}
+	client = NewSession(ws, nil)
+	server = <-servers
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// openTestStream opens a stream on the client and returns both of its ends
+func openTestStream(t *testing.T, client *Session, accepted chan *Stream) (local *Stream, remote *Stream) {
+	local, err := client.Open()
+	if err != nil {
+		t.Fatalf("Unable to open stream : %s", err)
+	}
+	err = local.WriteFrame(FrameTunnel, nil)
+	if err != nil {
+		t.Fatalf("Unable to write head : %s", err)
+	}
+	select {
+	case remote = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stream %d not accepted", local.ID)
+	}
+	return
+}
+
+// waitDone fails if the stream is not aborted with the expected error
+func waitDone(t *testing.T, stream *Stream, expected error) {
+	select {
+	case <-stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stream %d not aborted", stream.ID)
+	}
+	if stream.Err() != expected {
+		t.Fatalf("Stream %d aborted with %v, expected %v", stream.ID, stream.Err(), expected)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, _, accepted := newTestSessions(t)
+	local, remote := openTestStream(t, client, accepted)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*InitialWindow)/16)
+	written := make(chan error, 1)
+	go func() {
+		_, err := local.Write(data)
+		if err == nil {
+			err = local.CloseWrite()
+		}
+		written <- err
+	}()
+
+	// The writer blocks once the window is exhausted as nothing is read
+	select {
+	case err := <-written:
+		t.Fatalf("Write of %d bytes returned %v without window updates", len(data), err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	remote.lock.Lock()
+	buffered := remote.buffer.Len()
+	remote.lock.Unlock()
+	if buffered != InitialWindow {
+		t.Fatalf("Expected %d buffered bytes, got %d", InitialWindow, buffered)
+	}
+
+	// Reading grants window updates so that the writer can finish
+	received, err := ioutil.ReadAll(remote)
+	if err != nil {
+		t.Fatalf("Unable to read : %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Received %d bytes differing from the %d sent", len(received), len(data))
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Unable to write : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Writer still blocked after the data has been read")
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, _, accepted := newTestSessions(t)
+	local, remote := openTestStream(t, client, accepted)
+
+	local.Reset()
+	waitDone(t, local, ErrStreamClosed)
+	waitDone(t, remote, ErrStreamReset)
+
+	_, err := remote.Read(make([]byte, 1))
+	if err != ErrStreamReset {
+		t.Fatalf("Read returned %v, expected %v", err, ErrStreamReset)
+	}
+	_, err = local.Write([]byte("late"))
+	if err != ErrStreamClosed {
+		t.Fatalf("Write returned %v, expected %v", err, ErrStreamClosed)
+	}
+
+	// Other streams are not affected
+	other, otherRemote := openTestStream(t, client, accepted)
+	other.Write([]byte("still there"))
+	other.CloseWrite()
+	received, err := ioutil.ReadAll(otherRemote)
+	if err != nil || string(received) != "still there" {
+		t.Fatalf("Unexpected data %q and error %v on another stream", received, err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	client, _, accepted := newTestSessions(t)
+	local, remote := openTestStream(t, client, accepted)
+
+	local.Cancel()
+	waitDone(t, local, ErrStreamCanceled)
+	waitDone(t, remote, ErrStreamCanceled)
+
+	_, err := remote.Write([]byte("late"))
+	if err != ErrStreamCanceled {
+		t.Fatalf("Write returned %v, expected %v", err, ErrStreamCanceled)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server, accepted := newTestSessions(t)
+	local, remote := openTestStream(t, client, accepted)
+	other, otherRemote := openTestStream(t, client, accepted)
+
+	client.Close()
+	for _, session := range []*Session{client, server} {
+		select {
+		case <-session.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Session not closed")
+		}
+	}
+	for _, stream := range []*Stream{local, remote, other, otherRemote} {
+		waitDone(t, stream, ErrSessionClosed)
+	}
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Fatalf("Streams left after the session has been closed")
+	}
+
+	_, err := client.Open()
+	if err == nil {
+		t.Fatalf("Expected an error opening a stream on a closed session")
+	}
+	_, err = remote.Read(make([]byte, 1))
+	if err != ErrSessionClosed {
+		t.Fatalf("Read returned %v, expected %v", err, ErrSessionClosed)
+	}
+}
+
+func TestSessionReadLimit(t *testing.T) {
+	client, server, accepted := newTestSessions(t)
+	local, _ := openTestStream(t, client, accepted)
+
+	err := local.WriteFrame(FrameRequest, make([]byte, MaxFrameSize+1))
+	if err == nil {
+		t.Fatalf("Expected an error writing a frame larger than %d bytes", MaxFrameSize)
+	}
+
+	// A peer ignoring the maximum frame size gets disconnected
+	err = client.write(&Frame{Type: FrameData, StreamID: local.ID, Payload: make([]byte, MaxFrameSize+1)})
+	if err != nil {
+		t.Fatalf("Unable to write : %s", err)
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Session not closed after an oversized frame")
+	}
+	if server.Err() == nil || server.Err() == io.EOF {
+		t.Fatalf("Unexpected session error %v", server.Err())
+	}
+}
@@ -1,9 +1,72 @@
 package common
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// TimeoutHeader lets clients override the proxy timeouts of their request,
+// either a total duration ( ex : 30s ) or a list of dial, tls, header and total
+// durations ( ex : dial=2s,header=10s,total=1m )
+const TimeoutHeader = "X-PROXY-TIMEOUT"
+
+// Timeouts of a request, zero values fall back to the proxy configuration
+type Timeouts struct {
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	Total          time.Duration
+}
+
+// ParseTimeouts parses the value of the TimeoutHeader
+func ParseTimeouts(value string) (t Timeouts, err error) {
+	if !strings.Contains(value, "=") {
+		t.Total, err = parseTimeout(value)
+		return
+	}
+
+	var values StringMap
+	err = values.Set(value)
+	if err != nil {
+		return t, err
+	}
+
+	for key, value := range values {
+		var d time.Duration
+		d, err = parseTimeout(value)
+		if err != nil {
+			return t, err
+		}
+
+		switch key {
+		case "dial":
+			t.Dial = d
+		case "tls":
+			t.TLSHandshake = d
+		case "header":
+			t.ResponseHeader = d
+		case "total":
+			t.Total = d
+		default:
+			return t, fmt.Errorf("unknown timeout %q", key)
+		}
+	}
+	return
+}
+
+func parseTimeout(value string) (d time.Duration, err error) {
+	d, err = time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be greater than 0")
+	}
+	return
+}
+
 type HttpRequest struct {
 	Method           string
 	URL              string
@@ -12,6 +75,10 @@ type HttpRequest struct {
 	ProtoMinor       int
 	Header           http.Header
 	ContentLength    int64
+	Timeouts         Timeouts
+	// The proxy must return redirects instead of following them, the isolator
+	// can't check the client ACLs on the redirect destinations
+	NoRedirect       bool
 }
 
 func SerializeHttpRequest(req *http.Request) *HttpRequest {
@@ -34,4 +101,44 @@ func UnserializeHttpRequest(req *HttpRequest) *http.Request {
 	r.Header = req.Header
 	r.ContentLength = req.ContentLength
 	return r
-}
\ No newline at end of file
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (r *HttpRequest) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.writeString(r.Method)
+	e.writeString(r.URL)
+	e.writeString(r.Proto)
+	e.writeInt(int64(r.ProtoMajor))
+	e.writeInt(int64(r.ProtoMinor))
+	e.writeHeader(r.Header)
+	e.writeInt(r.ContentLength)
+	e.writeInt(int64(r.Timeouts.Dial))
+	e.writeInt(int64(r.Timeouts.TLSHandshake))
+	e.writeInt(int64(r.Timeouts.ResponseHeader))
+	e.writeInt(int64(r.Timeouts.Total))
+	noRedirect := int64(0)
+	if r.NoRedirect {
+		noRedirect = 1
+	}
+	e.writeInt(noRedirect)
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (r *HttpRequest) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	r.Method = d.readString()
+	r.URL = d.readString()
+	r.Proto = d.readString()
+	r.ProtoMajor = int(d.readInt())
+	r.ProtoMinor = int(d.readInt())
+	r.Header = d.readHeader()
+	r.ContentLength = d.readInt()
+	r.Timeouts.Dial = time.Duration(d.readInt())
+	r.Timeouts.TLSHandshake = time.Duration(d.readInt())
+	r.Timeouts.ResponseHeader = time.Duration(d.readInt())
+	r.Timeouts.Total = time.Duration(d.readInt())
+	r.NoRedirect = d.readInt() != 0
+	return d.err()
+}
@@ -24,4 +24,30 @@ func SerializeHttpResponse(resp *http.Response) *HttpResponse {
 	r.Header = resp.Header
 	r.ContentLength = resp.ContentLength
 	return r
-}
\ No newline at end of file
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (r *HttpResponse) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.writeString(r.Status)
+	e.writeInt(int64(r.StatusCode))
+	e.writeString(r.Proto)
+	e.writeInt(int64(r.ProtoMajor))
+	e.writeInt(int64(r.ProtoMinor))
+	e.writeHeader(r.Header)
+	e.writeInt(r.ContentLength)
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (r *HttpResponse) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	r.Status = d.readString()
+	r.StatusCode = int(d.readInt())
+	r.Proto = d.readString()
+	r.ProtoMajor = int(d.readInt())
+	r.ProtoMinor = int(d.readInt())
+	r.Header = d.readHeader()
+	r.ContentLength = d.readInt()
+	return d.err()
+}
@@ -0,0 +1,21 @@
+package common
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadCertPool reads a PEM encoded CA bundle
+func LoadCertPool(path string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA bundle : %s", err)
+	}
+
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in CA bundle %s", path)
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegisterTokenHeader is the header used by a proxy to authenticate on /register
+const RegisterTokenHeader = "X-PROXY-TOKEN"
+
+// RegisterNameHeader carries the pool name signed by the register token so that the
+// isolator can check the signature before upgrading the connection
+const RegisterNameHeader = "X-PROXY-NAME"
+
+// RegisterToken authenticates a proxy registering on the isolator.
+//
+// It is serialized as <key id>:<unix timestamp>:<nonce>:<signature> where the signature is
+// the hex encoded HMAC-SHA256 of "<pool name>\n<unix timestamp>\n<nonce>" using the key secret.
+// The key id allows the isolator to accept several keys at once to rotate them.
+// The nonce is random, the isolator accepts each nonce only once to prevent replays.
+type RegisterToken struct {
+	KeyID     string
+	Timestamp int64
+	Nonce     string
+	Signature []byte
+}
+
+func NewRegisterToken(keyID string, secret string, name string) (t *RegisterToken) {
+	t = new(RegisterToken)
+	t.KeyID = keyID
+	t.Timestamp = time.Now().Unix()
+	t.Nonce = newNonce()
+	t.Signature = t.sign(secret, name)
+	return
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to generate nonce : %s", err))
+	}
+	return hex.EncodeToString(nonce)
+}
+
+func ParseRegisterToken(value string) (t *RegisterToken, err error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	t = new(RegisterToken)
+	t.KeyID = parts[0]
+	t.Timestamp, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token timestamp")
+	}
+	t.Nonce = parts[2]
+	if t.Nonce == "" {
+		return nil, fmt.Errorf("malformed token nonce")
+	}
+	t.Signature, err = hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	return
+}
+
+func (t *RegisterToken) String() string {
+	return fmt.Sprintf("%s:%d:%s:%s", t.KeyID, t.Timestamp, t.Nonce, hex.EncodeToString(t.Signature))
+}
+
+func (t *RegisterToken) sign(secret string, name string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s\n%d\n%s", name, t.Timestamp, t.Nonce)))
+	return mac.Sum(nil)
+}
+
+// Verify checks the token signature for the given pool name
+func (t *RegisterToken) Verify(secret string, name string) bool {
+	return hmac.Equal(t.Signature, t.sign(secret, name))
+}
+
+// Age returns the time elapsed since the token has been issued
+func (t *RegisterToken) Age() time.Duration {
+	return time.Since(time.Unix(t.Timestamp, 0))
+}
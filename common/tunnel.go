@@ -0,0 +1,91 @@
+package common
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TunnelRequest asks a proxy to open a raw TCP connection ( HTTP CONNECT ),
+// the stream then carries the bytes of the connection in both directions
+type TunnelRequest struct {
+	// host:port of the destination
+	Address string
+	// Dial bounds the connection, Total the whole tunnel
+	Timeouts Timeouts
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (t *TunnelRequest) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.writeString(t.Address)
+	e.writeInt(int64(t.Timeouts.Dial))
+	e.writeInt(int64(t.Timeouts.TLSHandshake))
+	e.writeInt(int64(t.Timeouts.ResponseHeader))
+	e.writeInt(int64(t.Timeouts.Total))
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (t *TunnelRequest) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	t.Address = d.readString()
+	t.Timeouts.Dial = time.Duration(d.readInt())
+	t.Timeouts.TLSHandshake = time.Duration(d.readInt())
+	t.Timeouts.ResponseHeader = time.Duration(d.readInt())
+	t.Timeouts.Total = time.Duration(d.readInt())
+	return d.err()
+}
+
+// closeWriter is implemented by the connections that can be half closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay copies the bytes between a tunnel stream and a connection until both
+// directions are closed, each end of file is forwarded as a half close.
+// Everything is torn down if a direction fails.
+//
+// in is the number of bytes read from conn and sent on the stream,
+// out the number of bytes received on the stream and written to conn.
+func Relay(stream *Stream, conn net.Conn) (in int64, out int64) {
+	var wg sync.WaitGroup
+	var once sync.Once
+	abort := func(err error) {
+		once.Do(func() {
+			log.Printf("Tunnel aborted : %v", err)
+			stream.Reset()
+			conn.Close()
+		})
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var err error
+		out, err = io.Copy(conn, stream)
+		if err != nil {
+			abort(err)
+			return
+		}
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	// Bytes received from the connection
+	var err error
+	in, err = io.Copy(stream, conn)
+	if err == nil {
+		err = stream.CloseWrite()
+	}
+	if err != nil {
+		abort(err)
+	}
+
+	wg.Wait()
+	return
+}
@@ -1,10 +1,38 @@
 package main
 
 import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/root-gg/isolator/isolator"
 )
 
 func main() {
-	i := isolator.NewIsolator()
+	// Load configuration
+	config, err := isolator.LoadIsolatorConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	i, err := isolator.NewIsolator(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	/*
+	* Reload keys on SIGHUP
+	*/
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for {
+			<-c
+			log.Println("SIGHUP Detected, reloading keys")
+			i.Reload()
+		}
+	}()
+
 	i.Start()
 }
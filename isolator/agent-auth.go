@@ -0,0 +1,162 @@
+package isolator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// AgentKey is a shared secret allowing proxies to register
+type AgentKey struct {
+	ID     string
+	Secret string
+
+	// Pool names ( globs ) this key can register, any if empty
+	Names []string
+
+	// The key is rejected after this date, never if zero
+	Expires time.Time
+}
+
+func (key *AgentKey) allows(name string) bool {
+	if len(key.Names) == 0 {
+		return true
+	}
+	for _, pattern := range key.Names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentAuthenticator checks the register tokens of the proxies against a key file.
+// Several keys can be valid at once and the file can be reloaded to rotate them.
+type AgentAuthenticator struct {
+	path    string
+	maxSkew time.Duration
+
+	keys map[string]*AgentKey
+	lock sync.RWMutex
+
+	// Nonces of the accepted tokens, kept until the tokens are too old to be accepted
+	nonces    map[string]time.Time
+	nonceLock sync.Mutex
+}
+
+func NewAgentAuthenticator(path string, maxSkew time.Duration) (aa *AgentAuthenticator, err error) {
+	aa = new(AgentAuthenticator)
+	aa.path = path
+	aa.maxSkew = maxSkew
+	aa.nonces = make(map[string]time.Time)
+
+	err = aa.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload reads the key file again, the current keys are kept on error
+func (aa *AgentAuthenticator) Reload() error {
+	data, err := ioutil.ReadFile(aa.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read agent key file : %s", err)
+	}
+
+	var list []*AgentKey
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("Unable to parse agent key file %s : %s", aa.path, err)
+	}
+
+	keys := make(map[string]*AgentKey)
+	for _, key := range list {
+		if key.ID == "" || key.Secret == "" {
+			return fmt.Errorf("Invalid agent key file %s : ID and Secret are required", aa.path)
+		}
+		if _, ok := keys[key.ID]; ok {
+			return fmt.Errorf("Invalid agent key file %s : duplicate key %s", aa.path, key.ID)
+		}
+		keys[key.ID] = key
+	}
+
+	aa.lock.Lock()
+	aa.keys = keys
+	aa.lock.Unlock()
+
+	log.Printf("Loaded %d agent keys from %s", len(keys), aa.path)
+	return nil
+}
+
+// Check validates the register token of an upgrade request and returns the signed pool name,
+// the greeting of the proxy must then use this name
+func (aa *AgentAuthenticator) Check(r *http.Request) (name string, err error) {
+	value := r.Header.Get(common.RegisterTokenHeader)
+	if value == "" {
+		return "", fmt.Errorf("missing %s header", common.RegisterTokenHeader)
+	}
+	name = r.Header.Get(common.RegisterNameHeader)
+	if name == "" {
+		return "", fmt.Errorf("missing %s header", common.RegisterNameHeader)
+	}
+
+	token, err := common.ParseRegisterToken(value)
+	if err != nil {
+		return "", err
+	}
+
+	aa.lock.RLock()
+	key := aa.keys[token.KeyID]
+	aa.lock.RUnlock()
+
+	if key == nil {
+		return "", fmt.Errorf("unknown key %s", token.KeyID)
+	}
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return "", fmt.Errorf("expired key %s", token.KeyID)
+	}
+
+	age := token.Age()
+	if age > aa.maxSkew || age < -aa.maxSkew {
+		return "", fmt.Errorf("token timestamp is too far from the isolator clock ( %s )", age)
+	}
+
+	if !token.Verify(key.Secret, name) {
+		return "", fmt.Errorf("invalid signature for %s with key %s", name, key.ID)
+	}
+	if !key.allows(name) {
+		return "", fmt.Errorf("key %s is not allowed to register %s", key.ID, name)
+	}
+	if !aa.consume(token) {
+		return "", fmt.Errorf("replayed token for %s with key %s", name, key.ID)
+	}
+	return name, nil
+}
+
+// consume returns false if the nonce of the token has already been used
+func (aa *AgentAuthenticator) consume(token *common.RegisterToken) bool {
+	aa.nonceLock.Lock()
+	defer aa.nonceLock.Unlock()
+
+	now := time.Now()
+	for nonce, expires := range aa.nonces {
+		if now.After(expires) {
+			delete(aa.nonces, nonce)
+		}
+	}
+
+	nonce := token.KeyID + ":" + token.Nonce
+	if _, ok := aa.nonces[nonce]; ok {
+		return false
+	}
+	aa.nonces[nonce] = time.Unix(token.Timestamp, 0).Add(aa.maxSkew)
+	return true
+}
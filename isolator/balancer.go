@@ -0,0 +1,137 @@
+package isolator
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+// Balancer orders the candidate pools of a request,
+// the request is proxied through the first pool having an idle connection
+type Balancer interface {
+	Order(r *http.Request, pools []*ProxyPool) []*ProxyPool
+}
+
+// NewBalancer returns the balancer named in the configuration
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "round-robin":
+		return new(RoundRobinBalancer), nil
+	case "least-in-flight":
+		return new(LeastInFlightBalancer), nil
+	case "weighted":
+		return new(WeightedBalancer), nil
+	case "consistent-hash":
+		return new(ConsistentHashBalancer), nil
+	}
+	return nil, fmt.Errorf("Unknown balancer %q", name)
+}
+
+// RoundRobinBalancer starts each request on the pool following the previous one
+type RoundRobinBalancer struct {
+	next uint64
+}
+
+func (b *RoundRobinBalancer) Order(r *http.Request, pools []*ProxyPool) []*ProxyPool {
+	if len(pools) == 0 {
+		return pools
+	}
+
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(pools)))
+	ordered := make([]*ProxyPool, 0, len(pools))
+	ordered = append(ordered, pools[start:]...)
+	ordered = append(ordered, pools[:start]...)
+	return ordered
+}
+
+// LeastInFlightBalancer prefers the pools with the fewest requests in progress
+type LeastInFlightBalancer struct{}
+
+func (b *LeastInFlightBalancer) Order(r *http.Request, pools []*ProxyPool) []*ProxyPool {
+	inFlight := make(map[*ProxyPool]int)
+	for _, pool := range pools {
+		inFlight[pool] = pool.InFlight()
+	}
+
+	// Shuffle first so that ties are spread evenly
+	ordered := shuffle(pools)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return inFlight[ordered[i]] < inFlight[ordered[j]]
+	})
+	return ordered
+}
+
+// WeightedBalancer picks pools randomly in proportion to the capacity advertised by their proxies
+type WeightedBalancer struct{}
+
+func (b *WeightedBalancer) Order(r *http.Request, pools []*ProxyPool) []*ProxyPool {
+	remaining := make([]*ProxyPool, len(pools))
+	copy(remaining, pools)
+
+	weights := make([]int, len(pools))
+	total := 0
+	for i, pool := range remaining {
+		weights[i] = pool.Capacity()
+		if weights[i] <= 0 {
+			weights[i] = 1
+		}
+		total += weights[i]
+	}
+
+	// Weighted random sampling without replacement
+	ordered := make([]*ProxyPool, 0, len(pools))
+	for len(remaining) > 0 {
+		n := rand.Intn(total)
+		for i := range remaining {
+			n -= weights[i]
+			if n < 0 {
+				ordered = append(ordered, remaining[i])
+				total -= weights[i]
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				weights = append(weights[:i], weights[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// ConsistentHashBalancer always sends the requests for a destination host to the same pool
+// as long as it is available. It uses rendezvous hashing so that only the requests of a
+// removed pool are moved when the pools change.
+type ConsistentHashBalancer struct{}
+
+func (b *ConsistentHashBalancer) Order(r *http.Request, pools []*ProxyPool) []*ProxyPool {
+	host := r.Header.Get("X-PROXY-DESTINATION")
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	scores := make(map[*ProxyPool]uint64)
+	for _, pool := range pools {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		h.Write([]byte{0})
+		h.Write([]byte(pool.name))
+		scores[pool] = h.Sum64()
+	}
+
+	ordered := make([]*ProxyPool, len(pools))
+	copy(ordered, pools)
+	sort.Slice(ordered, func(i, j int) bool {
+		return scores[ordered[i]] > scores[ordered[j]]
+	})
+	return ordered
+}
+
+func shuffle(pools []*ProxyPool) []*ProxyPool {
+	shuffled := make([]*ProxyPool, len(pools))
+	for i, j := range rand.Perm(len(pools)) {
+		shuffled[i] = pools[j]
+	}
+	return shuffled
+}
@@ -0,0 +1,206 @@
+package isolator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ClientACL grants the client identities it applies to the right
+// to reach some destinations through some pools
+type ClientACL struct {
+	// Identity names ( globs ), "*" also matches anonymous clients
+	Identities []string
+
+	// Destination patterns [scheme://]host[:port] where host is a glob
+	// ( ex : https://*.example.com, api.internal:8443 ), any if empty
+	Destinations []string
+
+	// Pool names ( globs ), any if empty
+	Pools []string
+}
+
+// destinationPattern is a parsed ClientACL destination
+type destinationPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func parseDestinationPattern(value string) (dp *destinationPattern, err error) {
+	dp = new(destinationPattern)
+
+	if i := strings.Index(value, "://"); i >= 0 {
+		dp.scheme = strings.ToLower(value[:i])
+		value = value[i+3:]
+	}
+
+	dp.host = value
+	if host, port, e := net.SplitHostPort(value); e == nil {
+		dp.host = host
+		dp.port = port
+	}
+	dp.host = strings.ToLower(dp.host)
+
+	if _, err := path.Match(dp.host, ""); err != nil || dp.host == "" {
+		return nil, fmt.Errorf("invalid destination pattern %q", value)
+	}
+	return
+}
+
+func (dp *destinationPattern) matches(destination *url.URL) bool {
+	if dp.scheme != "" && dp.scheme != "*" && dp.scheme != strings.ToLower(destination.Scheme) {
+		return false
+	}
+	if dp.port != "" && dp.port != "*" && dp.port != destinationPort(destination) {
+		return false
+	}
+	ok, _ := path.Match(dp.host, strings.ToLower(destination.Hostname()))
+	return ok
+}
+
+// destinationPort returns the port of the destination or the default port of its scheme
+func destinationPort(destination *url.URL) string {
+	if port := destination.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(destination.Scheme) {
+	case "https", "wss":
+		return "443"
+	}
+	return "80"
+}
+
+// compiledACL is a ClientACL with parsed destination patterns
+type compiledACL struct {
+	*ClientACL
+	destinations []*destinationPattern
+}
+
+func matchGlobs(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientACLFile holds the client ACLs loaded from a JSON list of ClientACL.
+// A request is allowed if at least one ACL of its client identity allows both
+// its destination and one of its pools, clients without any ACL are denied.
+type ClientACLFile struct {
+	path string
+	acls []*compiledACL
+	lock sync.RWMutex
+}
+
+func NewClientACLFile(path string) (af *ClientACLFile, err error) {
+	af = new(ClientACLFile)
+	af.path = path
+
+	err = af.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload reads the ACL file again, the current ACLs are kept on error
+func (af *ClientACLFile) Reload() error {
+	data, err := ioutil.ReadFile(af.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read client ACL file : %s", err)
+	}
+
+	var list []*ClientACL
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("Unable to parse client ACL file %s : %s", af.path, err)
+	}
+
+	acls := make([]*compiledACL, 0, len(list))
+	for i, acl := range list {
+		if len(acl.Identities) == 0 {
+			return fmt.Errorf("Invalid client ACL file %s : ACL %d has no identity", af.path, i)
+		}
+		compiled := &compiledACL{ClientACL: acl}
+		for _, value := range acl.Destinations {
+			dp, err := parseDestinationPattern(value)
+			if err != nil {
+				return fmt.Errorf("Invalid client ACL file %s : ACL %d : %s", af.path, i, err)
+			}
+			compiled.destinations = append(compiled.destinations, dp)
+		}
+		acls = append(acls, compiled)
+	}
+
+	af.lock.Lock()
+	af.acls = acls
+	af.lock.Unlock()
+
+	log.Printf("Loaded %d client ACLs from %s", len(acls), af.path)
+	return nil
+}
+
+// Check returns the pools the identity can reach the destination through
+// or an error explaining why the request is denied
+func (af *ClientACLFile) Check(identity *Identity, destination *url.URL, pools []*ProxyPool) (allowed []*ProxyPool, err error) {
+	af.lock.RLock()
+	defer af.lock.RUnlock()
+
+	identityMatched := false
+	destinationMatched := false
+	selected := make(map[*ProxyPool]bool)
+
+	for _, acl := range af.acls {
+		if !matchGlobs(acl.Identities, identity.Name) {
+			continue
+		}
+		identityMatched = true
+
+		if len(acl.destinations) > 0 {
+			match := false
+			for _, dp := range acl.destinations {
+				if dp.matches(destination) {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		destinationMatched = true
+
+		for _, pool := range pools {
+			if len(acl.Pools) == 0 || matchGlobs(acl.Pools, pool.name) {
+				selected[pool] = true
+			}
+		}
+	}
+
+	switch {
+	case !identityMatched:
+		return nil, fmt.Errorf("no ACL for client %s", identity.Name)
+	case !destinationMatched:
+		return nil, fmt.Errorf("client %s is not allowed to reach %s", identity.Name, destination.Host)
+	}
+
+	// Keep the balancer order
+	for _, pool := range pools {
+		if selected[pool] {
+			allowed = append(allowed, pool)
+		}
+	}
+	if len(allowed) == 0 && len(pools) > 0 {
+		return nil, fmt.Errorf("client %s is not allowed to use pools %s", identity.Name, poolNames(pools))
+	}
+	return
+}
@@ -0,0 +1,220 @@
+package isolator
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ApiKeyHeader is the header used by clients to send a static API key
+const ApiKeyHeader = "X-PROXY-API-KEY"
+
+var errNoCredentials = errors.New("no credentials")
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	Name   string
+	Method string
+}
+
+type identityKey struct{}
+
+// anonymous is the identity of every client when authentication is disabled
+var anonymous = &Identity{Name: "anonymous", Method: "none"}
+
+// IdentityFromContext returns the client identity stored by the authentication
+func IdentityFromContext(ctx context.Context) *Identity {
+	if identity, ok := ctx.Value(identityKey{}).(*Identity); ok {
+		return identity
+	}
+	return anonymous
+}
+
+// ClientAuthenticator identifies the client of a /proxy request.
+// It must return errNoCredentials if the request carries no credentials it handles
+// and remove the credentials from the request so they are not sent to the destination.
+// The isolator credentials are sent in Proxy-Authorization, Authorization belongs to the destination.
+type ClientAuthenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// ClientKey is a credential of a client identity.
+// Type is one of "api-key", "basic" or "bearer", Username is only used by basic.
+type ClientKey struct {
+	Identity string
+	Type     string
+	Username string
+	Key      string
+}
+
+// ClientKeyFile holds the client credentials loaded from a JSON list of ClientKey
+type ClientKeyFile struct {
+	path string
+	keys []*ClientKey
+	lock sync.RWMutex
+}
+
+func NewClientKeyFile(path string) (kf *ClientKeyFile, err error) {
+	kf = new(ClientKeyFile)
+	kf.path = path
+
+	err = kf.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload reads the key file again, the current keys are kept on error
+func (kf *ClientKeyFile) Reload() error {
+	data, err := ioutil.ReadFile(kf.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read client key file : %s", err)
+	}
+
+	var keys []*ClientKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("Unable to parse client key file %s : %s", kf.path, err)
+	}
+
+	for _, key := range keys {
+		if key.Identity == "" || key.Key == "" {
+			return fmt.Errorf("Invalid client key file %s : Identity and Key are required", kf.path)
+		}
+		switch key.Type {
+		case "api-key", "bearer":
+		case "basic":
+			if key.Username == "" {
+				return fmt.Errorf("Invalid client key file %s : Username is required for %s", kf.path, key.Identity)
+			}
+		default:
+			return fmt.Errorf("Invalid client key file %s : unknown key type %q", kf.path, key.Type)
+		}
+	}
+
+	kf.lock.Lock()
+	kf.keys = keys
+	kf.lock.Unlock()
+
+	log.Printf("Loaded %d client keys from %s", len(keys), kf.path)
+	return nil
+}
+
+// lookup returns the identity matching the credentials using constant time comparisons
+func (kf *ClientKeyFile) lookup(keyType string, username string, key string) (identity *Identity) {
+	kf.lock.RLock()
+	defer kf.lock.RUnlock()
+
+	for _, k := range kf.keys {
+		if k.Type != keyType {
+			continue
+		}
+		match := subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1
+		if keyType == "basic" {
+			match = match && subtle.ConstantTimeCompare([]byte(k.Username), []byte(username)) == 1
+		}
+		if match && identity == nil {
+			identity = &Identity{Name: k.Identity, Method: keyType}
+		}
+	}
+	return
+}
+
+// ApiKeyAuthenticator checks the X-PROXY-API-KEY header
+type ApiKeyAuthenticator struct {
+	keys *ClientKeyFile
+}
+
+func (a *ApiKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(ApiKeyHeader)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	r.Header.Del(ApiKeyHeader)
+
+	if identity := a.keys.lookup("api-key", "", key); identity != nil {
+		return identity, nil
+	}
+	return nil, fmt.Errorf("invalid API key")
+}
+
+// ProxyAuthorizationHeader carries the basic or bearer credentials of the clients
+const ProxyAuthorizationHeader = "Proxy-Authorization"
+
+// BasicAuthenticator checks the HTTP basic Proxy-Authorization header
+type BasicAuthenticator struct {
+	keys *ClientKeyFile
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	// Parse the header like http.Request.BasicAuth does for Authorization
+	credentials := &http.Request{Header: http.Header{"Authorization": r.Header.Values(ProxyAuthorizationHeader)}}
+	username, password, ok := credentials.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+	r.Header.Del(ProxyAuthorizationHeader)
+
+	if identity := a.keys.lookup("basic", username, password); identity != nil {
+		return identity, nil
+	}
+	return nil, fmt.Errorf("invalid username or password for %s", username)
+}
+
+// BearerAuthenticator checks the Proxy-Authorization: Bearer header
+type BearerAuthenticator struct {
+	keys *ClientKeyFile
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	authorization := r.Header.Get(ProxyAuthorizationHeader)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, errNoCredentials
+	}
+	r.Header.Del(ProxyAuthorizationHeader)
+
+	if identity := a.keys.lookup("bearer", "", strings.TrimPrefix(authorization, "Bearer ")); identity != nil {
+		return identity, nil
+	}
+	return nil, fmt.Errorf("invalid bearer token")
+}
+
+// ClientAuthenticators tries each authenticator in order until one finds credentials
+type ClientAuthenticators []ClientAuthenticator
+
+func (authenticators ClientAuthenticators) Authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errNoCredentials
+}
+
+// NewClientAuthenticator builds the authenticators for the given methods
+func NewClientAuthenticator(keys *ClientKeyFile, methods []string) (ClientAuthenticator, error) {
+	authenticators := make(ClientAuthenticators, 0)
+	for _, method := range methods {
+		switch method {
+		case "api-key":
+			authenticators = append(authenticators, &ApiKeyAuthenticator{keys: keys})
+		case "basic":
+			authenticators = append(authenticators, &BasicAuthenticator{keys: keys})
+		case "bearer":
+			authenticators = append(authenticators, &BearerAuthenticator{keys: keys})
+		default:
+			return nil, fmt.Errorf("Unknown client authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
@@ -0,0 +1,180 @@
+package isolator
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+type IsolatorConfig struct {
+	Listen common.StringList
+	// Addresses to serve as a standard HTTP forward proxy ( HTTP_PROXY )
+	ForwardListen common.StringList
+	// Addresses to serve as a SOCKS5 proxy, the connections go out of
+	// SocksPools ( any pool if empty )
+	SocksListen common.StringList
+	SocksPools  common.StringList
+
+	TLSCert string
+	TLSKey  string
+
+	// CA bundle to verify client certificates, proxies registering with
+	// a certificate are named after its common name when AgentCertAuth is set
+	TLSClientCA   string
+	AgentCertAuth bool
+
+	ReadTimeout  common.Duration
+	WriteTimeout common.Duration
+	IdleTimeout  common.Duration
+
+	PoolSize int
+	// Requests wait at most AcquireTimeout for an available connection, clients can
+	// ask for another timeout up to MaxAcquireTimeout with the X-PROXY-ACQUIRE-TIMEOUT header
+	AcquireTimeout    common.Duration
+	MaxAcquireTimeout common.Duration
+	// Maximum number of requests waiting for a connection of each pool
+	QueueSize int
+
+	// Pools without any live connection are removed after PoolGracePeriod
+	PoolGracePeriod common.Duration
+
+	// Proxies are pinged every HeartbeatInterval and their connection is closed
+	// if nothing is received for HeartbeatInterval + HeartbeatTimeout ( 0 = disabled )
+	HeartbeatInterval common.Duration
+	HeartbeatTimeout  common.Duration
+
+	// Pool selection strategy : round-robin, least-in-flight, weighted or consistent-hash
+	Balancer string
+
+	// JSON list of AgentKey, proxies are not authenticated if empty
+	AgentKeysFile string
+	MaxClockSkew  common.Duration
+
+	// JSON list of ClientKey, clients are not authenticated if empty
+	ClientKeysFile string
+	ClientAuth     common.StringList
+
+	// JSON list of ClientACL, clients can reach any destination if empty
+	ClientACLFile string
+}
+
+func NewIsolatorConfig() (ic *IsolatorConfig) {
+	ic = new(IsolatorConfig)
+	ic.Listen = common.StringList{"127.0.0.1:8080"}
+	ic.IdleTimeout = common.Duration(2 * time.Minute)
+	ic.PoolSize = 1000
+	ic.PoolGracePeriod = common.Duration(time.Minute)
+	ic.AcquireTimeout = common.Duration(time.Second)
+	ic.MaxAcquireTimeout = common.Duration(30 * time.Second)
+	ic.QueueSize = 1000
+	ic.HeartbeatInterval = common.Duration(15 * time.Second)
+	ic.HeartbeatTimeout = common.Duration(30 * time.Second)
+	ic.Balancer = "round-robin"
+	ic.MaxClockSkew = common.Duration(5 * time.Minute)
+	ic.ClientAuth = common.StringList{"api-key", "basic", "bearer"}
+	return
+}
+
+// RegisterFlags binds the configuration fields to command line flags
+func (ic *IsolatorConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&ic.Listen, "listen", "comma separated list of addresses to listen on")
+	fs.Var(&ic.ForwardListen, "forward-listen", "comma separated list of addresses to listen on as a standard HTTP forward proxy")
+	fs.Var(&ic.SocksListen, "socks-listen", "comma separated list of addresses to listen on as a SOCKS5 proxy")
+	fs.Var(&ic.SocksPools, "socks-pools", "comma separated list of the proxy pools SOCKS5 connections can go out of")
+	fs.StringVar(&ic.TLSCert, "tls-cert", ic.TLSCert, "TLS certificate file ( enables HTTPS )")
+	fs.StringVar(&ic.TLSKey, "tls-key", ic.TLSKey, "TLS private key file")
+	fs.StringVar(&ic.TLSClientCA, "tls-client-ca", ic.TLSClientCA, "CA bundle to verify client certificates")
+	fs.BoolVar(&ic.AgentCertAuth, "agent-cert-auth", ic.AgentCertAuth, "require a client certificate on /register and use its common name as pool name")
+	fs.Var(&ic.ReadTimeout, "read-timeout", "maximum duration for reading an entire request ( 0 = none )")
+	fs.Var(&ic.WriteTimeout, "write-timeout", "maximum duration before timing out writes of a response ( 0 = none )")
+	fs.Var(&ic.IdleTimeout, "idle-timeout", "maximum duration to wait for the next request on keep-alive connections")
+	fs.IntVar(&ic.PoolSize, "pool-size", ic.PoolSize, "maximum number of idle connections per proxy pool")
+	fs.Var(&ic.AcquireTimeout, "acquire-timeout", "maximum time a request waits for an available proxy connection")
+	fs.Var(&ic.MaxAcquireTimeout, "max-acquire-timeout", "maximum acquire timeout clients can ask for with the X-PROXY-ACQUIRE-TIMEOUT header")
+	fs.IntVar(&ic.QueueSize, "queue-size", ic.QueueSize, "maximum number of requests waiting for a connection of each pool")
+	fs.Var(&ic.PoolGracePeriod, "pool-grace-period", "time to keep a pool without any live connection before removing it")
+	fs.Var(&ic.HeartbeatInterval, "heartbeat-interval", "interval between two pings of the proxies connections ( 0 = disabled )")
+	fs.Var(&ic.HeartbeatTimeout, "heartbeat-timeout", "time to wait for a pong before closing a proxy connection")
+	fs.StringVar(&ic.Balancer, "balancer", ic.Balancer, "pool selection strategy ( round-robin, least-in-flight, weighted, consistent-hash )")
+	fs.StringVar(&ic.AgentKeysFile, "agent-keys-file", ic.AgentKeysFile, "JSON file of the keys proxies must sign their registration with ( reloaded on SIGHUP )")
+	fs.Var(&ic.MaxClockSkew, "max-clock-skew", "maximum age of a proxy registration token")
+	fs.StringVar(&ic.ClientKeysFile, "client-keys-file", ic.ClientKeysFile, "JSON file of the client credentials allowed on /proxy ( reloaded on SIGHUP )")
+	fs.StringVar(&ic.ClientACLFile, "client-acl-file", ic.ClientACLFile, "JSON file of the destinations and pools allowed to each client ( reloaded on SIGHUP )")
+	fs.Var(&ic.ClientAuth, "client-auth", "comma separated list of client authentication methods ( api-key, basic, bearer )")
+}
+
+func (ic *IsolatorConfig) Validate() error {
+	if len(ic.Listen) == 0 {
+		return fmt.Errorf("At least one listen address is required")
+	}
+	if (ic.TLSCert == "") != (ic.TLSKey == "") {
+		return fmt.Errorf("Both TLSCert and TLSKey are required to enable TLS")
+	}
+	if ic.TLSClientCA != "" && ic.TLSCert == "" {
+		return fmt.Errorf("TLSClientCA requires TLS to be enabled")
+	}
+	if ic.AgentCertAuth && ic.TLSClientCA == "" {
+		return fmt.Errorf("AgentCertAuth requires TLSClientCA")
+	}
+	if ic.ReadTimeout < 0 || ic.WriteTimeout < 0 || ic.IdleTimeout < 0 {
+		return fmt.Errorf("Timeouts must be positive")
+	}
+	if ic.AcquireTimeout <= 0 {
+		return fmt.Errorf("AcquireTimeout must be greater than 0")
+	}
+	if ic.MaxAcquireTimeout < ic.AcquireTimeout {
+		return fmt.Errorf("MaxAcquireTimeout must be greater than or equal to AcquireTimeout")
+	}
+	if ic.QueueSize < 0 {
+		return fmt.Errorf("QueueSize must be positive")
+	}
+	if ic.PoolGracePeriod < 0 {
+		return fmt.Errorf("PoolGracePeriod must be positive")
+	}
+	if ic.HeartbeatInterval < 0 || ic.HeartbeatTimeout < 0 {
+		return fmt.Errorf("Heartbeat durations must be positive")
+	}
+	if ic.HeartbeatInterval > 0 && ic.HeartbeatTimeout <= ic.HeartbeatInterval {
+		return fmt.Errorf("HeartbeatTimeout must be greater than HeartbeatInterval")
+	}
+	if ic.MaxClockSkew <= 0 {
+		return fmt.Errorf("MaxClockSkew must be greater than 0")
+	}
+	if _, err := NewBalancer(ic.Balancer); err != nil {
+		return err
+	}
+	if ic.ClientKeysFile != "" && len(ic.ClientAuth) == 0 {
+		return fmt.Errorf("At least one client authentication method is required")
+	}
+	if len(ic.SocksListen) > 0 && ic.ClientKeysFile != "" && !ic.ClientAuth.Contains("basic") {
+		return fmt.Errorf("SocksListen requires the basic client authentication method")
+	}
+	if ic.PoolSize <= 0 {
+		return fmt.Errorf("PoolSize must be greater than 0")
+	}
+	return nil
+}
+
+// LoadIsolatorConfig loads the configuration from the command line arguments,
+// the ISOLATOR_* environment variables and the file given by -config
+func LoadIsolatorConfig(args []string) (ic *IsolatorConfig, err error) {
+	ic = NewIsolatorConfig()
+
+	fs := flag.NewFlagSet("isolator", flag.ContinueOnError)
+	fs.String("config", "", "configuration file ( JSON )")
+	ic.RegisterFlags(fs)
+
+	err = common.LoadConfig(ic, fs, args, "ISOLATOR")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ic.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration : %s", err)
+	}
+
+	return
+}
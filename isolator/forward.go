@@ -0,0 +1,70 @@
+package isolator
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers, they are meant for the isolator and must not reach the destination
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// forward serves the requests of the clients using the isolator as a standard
+// forward proxy ( GET http://host/path HTTP/1.1 ), like the ones of curl with HTTP_PROXY.
+// CONNECT requests are tunneled through the proxies.
+func (i *Isolator) forward(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		// CONNECT host:port HTTP/1.1
+		if _, _, err := net.SplitHostPort(r.Host); err != nil {
+			http.Error(w, "CONNECT requests must target host:port", 400)
+			return
+		}
+	} else if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "This is a forward proxy, requests must use an absolute URI", 400)
+		return
+	}
+
+	// Forward proxy clients send their credentials in Proxy-Authorization like on /proxy
+	identity, err := i.authenticate(r)
+	if err != nil {
+		log.Printf("Rejected client %s : %s", r.RemoteAddr, err)
+		clientsRejectedTotal.Inc()
+		w.Header().Set("Proxy-Authenticate", `Basic realm="isolator"`)
+		http.Error(w, "Proxy Authentication Required", 407)
+		return
+	}
+
+	removeHopHeaders(r.Header)
+	if r.Method == http.MethodConnect {
+		// The policy of the proxy and the ACLs match tcp destinations
+		r.Header.Set("X-PROXY-DESTINATION", "tcp://"+r.Host)
+	} else {
+		r.Header.Set("X-PROXY-DESTINATION", r.URL.String())
+	}
+
+	i.handle(w, r, identity)
+}
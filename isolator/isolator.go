@@ -5,93 +5,373 @@ import (
 	"net/http"
 
 	"github.com/gorilla/websocket"
+	"github.com/root-gg/isolator/common"
 	"sync"
 	"time"
 	"fmt"
 	"math/rand"
+	"encoding/json"
+	"context"
+	"crypto/tls"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Isolator struct {
+	config *IsolatorConfig
 	upgrader websocket.Upgrader
 
 	pools map[string]*ProxyPool
 	poolsNames []string
+	poolEvents []*PoolEvent
 
 	lock sync.RWMutex
+
+	started time.Time
+	tlsConfig *tls.Config
+	balancer Balancer
+
+	agentAuth *AgentAuthenticator
+	clientKeys *ClientKeyFile
+	clientAuth ClientAuthenticator
+	clientACLs *ClientACLFile
 }
 
-func NewIsolator() (i *Isolator) {
+func NewIsolator(config *IsolatorConfig) (i *Isolator, err error) {
 	rand.Seed(time.Now().Unix())
 
 	i = new(Isolator)
+	i.config = config
 	i.pools = make(map[string]*ProxyPool)
-	i.upgrader = websocket.Upgrader{}
+	i.upgrader = websocket.Upgrader{Subprotocols: []string{common.Subprotocol}}
+	i.started = time.Now()
+
+	i.balancer, err = NewBalancer(config.Balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TLSClientCA != "" {
+		i.tlsConfig = new(tls.Config)
+		i.tlsConfig.ClientCAs, err = common.LoadCertPool(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		// Clients of /proxy are not required to have a certificate
+		i.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if config.AgentKeysFile != "" {
+		i.agentAuth, err = NewAgentAuthenticator(config.AgentKeysFile, time.Duration(config.MaxClockSkew))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("No agent key file configured, anyone can register as a proxy")
+	}
+
+	if config.ClientKeysFile != "" {
+		i.clientKeys, err = NewClientKeyFile(config.ClientKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		i.clientAuth, err = NewClientAuthenticator(i.clientKeys, config.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("No client key file configured, anyone can use the proxies")
+	}
+
+	if config.ClientACLFile != "" {
+		i.clientACLs, err = NewClientACLFile(config.ClientACLFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the first isolator of the process exposes its pool gauges
+	err = prometheus.Register(i)
+	if err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return nil, fmt.Errorf("Unable to register metrics : %s", err)
+		}
+		err = nil
+	}
+
 	return
 }
 
+// Reload reads the key files again to rotate the keys without restarting
+func (i *Isolator) Reload() {
+	if i.agentAuth != nil {
+		err := i.agentAuth.Reload()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if i.clientKeys != nil {
+		err := i.clientKeys.Reload()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if i.clientACLs != nil {
+		err := i.clientACLs.Reload()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func (i *Isolator) Start() {
+	go i.poolJanitor()
+
 	r := http.NewServeMux()
 	r.HandleFunc("/proxy", i.proxy)
 	r.HandleFunc("/register", i.register)
 	r.HandleFunc("/stats", i.stats)
 	r.HandleFunc("/test", i.stats)
+	r.Handle("/metrics", promhttp.Handler())
 
-	s := &http.Server{Addr: "127.0.0.1:8080", Handler: r}
-	log.Fatal(s.ListenAndServe())
+	errors := make(chan error)
+	for _, address := range i.config.Listen {
+		s := &http.Server{
+			Addr:         address,
+			Handler:      r,
+			ReadTimeout:  time.Duration(i.config.ReadTimeout),
+			WriteTimeout: time.Duration(i.config.WriteTimeout),
+			IdleTimeout:  time.Duration(i.config.IdleTimeout),
+			TLSConfig:    i.tlsConfig,
+		}
+
+		go func() {
+			if i.config.TLSCert != "" {
+				log.Printf("Listening on https://%s", s.Addr)
+				errors <- s.ListenAndServeTLS(i.config.TLSCert, i.config.TLSKey)
+			} else {
+				log.Printf("Listening on http://%s", s.Addr)
+				errors <- s.ListenAndServe()
+			}
+		}()
+	}
+
+	// Standard forward proxy listeners ( HTTP_PROXY )
+	for _, address := range i.config.ForwardListen {
+		s := &http.Server{
+			Addr:         address,
+			Handler:      http.HandlerFunc(i.forward),
+			ReadTimeout:  time.Duration(i.config.ReadTimeout),
+			WriteTimeout: time.Duration(i.config.WriteTimeout),
+			IdleTimeout:  time.Duration(i.config.IdleTimeout),
+		}
+
+		go func() {
+			log.Printf("Listening as a forward proxy on http://%s", s.Addr)
+			errors <- s.ListenAndServe()
+		}()
+	}
+
+	// SOCKS5 listeners
+	for _, address := range i.config.SocksListen {
+		address := address
+		go func() {
+			log.Printf("Listening as a SOCKS5 proxy on %s", address)
+			errors <- i.serveSocks(address)
+		}()
+	}
+
+	log.Fatal(<-errors)
 }
 
 // This is the way for client to execute HTTP requests through a proxy
 func (i *Isolator) proxy(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%v %v",r.Method,r.Header)
+	identity, err := i.authenticate(r)
+	if err != nil {
+		log.Printf("Rejected client %s : %s", r.RemoteAddr, err)
+		clientsRejectedTotal.Inc()
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	i.handle(w, r, identity)
+}
+
+// authenticate returns the identity of the client, anonymous if authentication is disabled
+func (i *Isolator) authenticate(r *http.Request) (*Identity, error) {
+	if i.clientAuth == nil {
+		return anonymous, nil
+	}
+	return i.clientAuth.Authenticate(r)
+}
+
+// handle proxies the request of an authenticated client to its X-PROXY-DESTINATION
+func (i *Isolator) handle(w http.ResponseWriter, r *http.Request, identity *Identity) {
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	clientRequestsTotal.WithLabelValues(identity.Name).Inc()
+
+	log.Printf("%s : %v %v",identity.Name,r.Method,r.Header)
 
-	if len(i.poolsNames) == 0 {
+	pools, err := i.selectPools(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Check the client ACLs before taking a connection
+	if i.clientACLs != nil {
+		destination, err := url.Parse(r.Header.Get("X-PROXY-DESTINATION"))
+		if err == nil && destination.Host == "" {
+			err = fmt.Errorf("missing host")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid X-PROXY-DESTINATION header : %s", err), 400)
+			return
+		}
+
+		pools, err = i.clientACLs.Check(identity, destination, pools)
+		if err != nil {
+			log.Printf("Denied request of %s : %s", identity.Name, err)
+			clientsDeniedTotal.WithLabelValues(identity.Name).Inc()
+			http.Error(w, fmt.Sprintf("Forbidden : %s", err), 403)
+			return
+		}
+	}
+
+	if len(pools) == 0 {
 		http.Error(w,fmt.Sprintf("No proxy available"),526)
+		return
 	}
 
-	index := rand.Intn(len(i.poolsNames))
+	timeout, err := i.acquireTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Timeouts enforced by the proxy
+	var timeouts common.Timeouts
+	if value := r.Header.Get(common.TimeoutHeader); value != "" {
+		timeouts, err = common.ParseTimeouts(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s header : %s", common.TimeoutHeader, err), 400)
+			return
+		}
+		r.Header.Del(common.TimeoutHeader)
+	}
+
+	pools = i.balancer.Order(r, pools)
+
 	start := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 
 	for {
-		if time.Now().Sub(start).Seconds() > 1 {
-			break
+		// Get an available connection in the balancer order,
+		// or wait for one on the preferred pool that still has live connections
+		var pc *ProxyConnection
+		var preferred *ProxyPool
+		for _, proxy := range pools {
+			if pc = proxy.TryTake(); pc != nil {
+				break
+			}
+			if preferred == nil && proxy.Live() > 0 {
+				preferred = proxy
+			}
+		}
+		if pc == nil {
+			if preferred == nil {
+				preferred = pools[0]
+			}
+			pc, err = preferred.Take(ctx)
+			if err == ErrQueueFull {
+				acquireFailuresTotal.WithLabelValues(preferred.name, "queue-full").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("Too many requests waiting for a proxy connection from %s", preferred.name), 503)
+				return
+			}
+			if err != nil && r.Context().Err() != nil {
+				acquireFailuresTotal.WithLabelValues(preferred.name, "canceled").Inc()
+				log.Printf("Request canceled by %s while waiting for a proxy connection", identity.Name)
+				return
+			}
+			if err != nil {
+				acquireFailuresTotal.WithLabelValues(preferred.name, "timeout").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("Unable to get an available proxy connection from %s", poolNames(pools)), 503)
+				return
+			}
 		}
+		acquireWait.WithLabelValues(pc.pp.name).Observe(time.Since(start).Seconds())
 
-		// Get a pool
-		i.lock.RLock()
-		index = (index + 1) % len(i.poolsNames)
-		proxy := i.pools[i.poolsNames[index]]
-		log.Printf("%v / %v",index,len(i.poolsNames))
-		i.lock.RUnlock()
+		// The connection might have been closed or filled since it was taken
+		stream, err := pc.Open()
+		if err != nil {
+			continue
+		}
 
-		if pc := proxy.Take(); pc != nil {
-			if pc.status != IDLE && time.Now().Sub(start).Seconds() < 1 {
-				continue
+		if r.Method == http.MethodConnect {
+			if !pc.greeting.HasCapability("tunnel") {
+				pc.release()
+				stream.Reset()
+				http.Error(w, fmt.Sprintf("Proxy %s does not support CONNECT tunnels", pc.pp.name), 502)
+				return
 			}
+			err = pc.proxyTunnel(stream, w, r, timeouts)
+		} else {
+			// Redirects could lead to destinations denied by the client ACLs
+			err = pc.proxyRequest(stream, w, r, timeouts, i.clientACLs != nil)
+		}
+		if err != nil && r.Context().Err() != nil {
+			log.Printf("Request canceled by %s : %s", identity.Name, err)
+		} else if err != nil {
+			// An error occurred, only this stream is aborted
+			log.Println(err)
 
-			err := pc.proxyRequest(w, r)
-			if err == nil {
-				// Everything went well we can reuse the connection
-				//proxy.Offer(pc)
-				pc.Close()
+			// Try to return an error to the client
+			// This might fail if response headers have already been sent
+			if proxyError, ok := err.(*common.ProxyError); ok {
+				w.Header().Set(common.ErrorHeader, proxyError.Class)
+				http.Error(w, proxyError.Detail, proxyError.StatusCode())
 			} else {
-				// An error occurred throw the connection away
-				log.Println(err)
-				pc.Close()
-
-				// Try to return an error to the client
-				// This might fail if response headers have already been sent
 				http.Error(w, err.Error(), 526)
 			}
-			return
 		}
-		time.Sleep(10 * time.Millisecond)
+		return
 	}
-
-	http.Error(w,fmt.Sprintf("Unable to get a proxy connection"),526)
 }
 
+// Maximum time for a proxy to send its greeting once upgraded
+const greetingTimeout = 10 * time.Second
+
 // This is the way for proxy to offer websocket connections
 func (i *Isolator) register(w http.ResponseWriter, r *http.Request) {
+	certName := ""
+	if i.config.AgentCertAuth {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Printf("Rejected proxy registration from %s : missing client certificate", r.RemoteAddr)
+			registrationsRejectedTotal.Inc()
+			http.Error(w, "Client certificate required", 401)
+			return
+		}
+		certName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	// Proxies are authenticated before being upgraded
+	signedName := ""
+	if i.agentAuth != nil {
+		var err error
+		signedName, err = i.agentAuth.Check(r)
+		if err != nil {
+			log.Printf("Rejected proxy registration from %s : %s", r.RemoteAddr, err)
+			registrationsRejectedTotal.Inc()
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
+
 	ws, err := i.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("upgrade proxy error : %v", err)
@@ -100,14 +380,44 @@ func (i *Isolator) register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//
-	_, greeting, err := ws.ReadMessage()
+	if ws.Subprotocol() != common.Subprotocol {
+		log.Printf("Rejected proxy registration from %s : unsupported protocol, %s is required", r.RemoteAddr, common.Subprotocol)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol"), time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(greetingTimeout))
+	greeting, err := common.ReadGreeting(ws)
+	ws.SetReadDeadline(time.Time{})
+	if err == nil && !greeting.HasCapability("mux") {
+		err = fmt.Errorf("Proxy %s does not support multiplexing, please upgrade it", greeting.Name)
+	}
 	if err != nil {
-		log.Println("greeting error")
+		log.Printf("Rejected proxy registration from %s : %s", r.RemoteAddr, err)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error()), time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	hostname := greeting.Name
+
+	if i.agentAuth != nil && hostname != signedName {
+		log.Printf("Rejected proxy registration from %s : greeted as %s but the token is signed for %s", r.RemoteAddr, hostname, signedName)
+		registrationsRejectedTotal.Inc()
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"), time.Now().Add(time.Second))
 		ws.Close()
 		return
 	}
 
-	hostname := string(greeting)
+	// The certificate identity takes precedence over the greeting
+	if certName != "" {
+		if hostname != certName {
+			log.Printf("Proxy %s greeted as %s, using certificate name", certName, hostname)
+		}
+		hostname = certName
+		greeting.Name = certName
+	}
 
 	i.lock.Lock()
 	defer i.lock.Unlock()
@@ -115,17 +425,25 @@ func (i *Isolator) register(w http.ResponseWriter, r *http.Request) {
 	// Get that proxy connection pool
 	pool, ok := i.pools[hostname]
 	if (!ok){
-		pool = NewProxyPool(hostname)
-		i.pools[hostname] = pool
-		i.poolsNames = append(i.poolsNames,hostname)
+		pool = i.addPool(hostname)
 	}
 
 	// Add the ws to the pool
-	pool.Register(ws)
+	pc := pool.Register(ws, greeting)
+	pc.session.Heartbeat(time.Duration(i.config.HeartbeatInterval), time.Duration(i.config.HeartbeatTimeout))
 }
 
+// This is the way to monitor the pools and connections
 func (i *Isolator) stats(w http.ResponseWriter, r *http.Request) {
-	//TODO
+	body, err := json.MarshalIndent(i.Stats(), "", "  ")
+	if err != nil {
+		log.Printf("Unable to serialize stats : %s", err)
+		http.Error(w, fmt.Sprintf("Unable to serialize stats : %s", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
 }
 
 func (i *Isolator) test(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,150 @@
+package isolator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "requests_total",
+		Help:      "Number of proxied requests by pool and status code.",
+	}, []string{"pool", "code"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isolator",
+		Name:      "upstream_latency_seconds",
+		Help:      "Time between sending the request to the proxy and receiving the response headers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isolator",
+		Name:      "request_duration_seconds",
+		Help:      "Total time spent proxying a request including the bodies.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+
+	bodyBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "body_bytes_total",
+		Help:      "Number of body bytes piped by pool and direction ( in = response, out = request ).",
+	}, []string{"pool", "direction"})
+
+	connectionsRegisteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "connections_registered_total",
+		Help:      "Number of websocket connections registered by proxies.",
+	}, []string{"pool"})
+
+	connectionsClosedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "connections_closed_total",
+		Help:      "Number of websocket connections closed.",
+	}, []string{"pool"})
+
+	connectionsDeadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "connections_dead_total",
+		Help:      "Number of websocket connections closed because the proxy did not answer the heartbeat.",
+	}, []string{"pool"})
+
+	clientsDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "clients_denied_total",
+		Help:      "Number of requests denied by the client ACLs by client identity.",
+	}, []string{"client"})
+
+	poolsCreatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "pools_created_total",
+		Help:      "Number of proxy pools created by a registration.",
+	})
+
+	poolsRemovedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "pools_removed_total",
+		Help:      "Number of proxy pools removed after staying without live connections for the grace period.",
+	})
+
+	registrationsRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "registrations_rejected_total",
+		Help:      "Number of proxy registrations rejected by the agent authentication.",
+	})
+
+	clientRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "client_requests_total",
+		Help:      "Number of authenticated requests by client identity.",
+	}, []string{"client"})
+
+	clientsRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "clients_rejected_total",
+		Help:      "Number of requests rejected by the client authentication.",
+	})
+
+	acquireWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isolator",
+		Name:      "acquire_wait_seconds",
+		Help:      "Time spent waiting for an available proxy connection.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+
+	acquireFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isolator",
+		Name:      "acquire_failures_total",
+		Help:      "Number of requests that did not get a proxy connection by pool and reason ( timeout, queue-full, canceled ).",
+	}, []string{"pool", "reason"})
+
+	poolQueueLengthDesc = prometheus.NewDesc(
+		"isolator_pool_queue_length",
+		"Number of requests waiting for a connection by pool.",
+		[]string{"pool"}, nil)
+
+	poolConnectionsDesc = prometheus.NewDesc(
+		"isolator_pool_connections",
+		"Number of live websocket connections by pool and status ( idle, in-flight when carrying at least one stream ).",
+		[]string{"pool", "status"}, nil)
+
+	poolStreamsDesc = prometheus.NewDesc(
+		"isolator_pool_streams",
+		"Number of requests in progress by pool.",
+		[]string{"pool"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(upstreamLatency)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(bodyBytesTotal)
+	prometheus.MustRegister(connectionsRegisteredTotal)
+	prometheus.MustRegister(connectionsClosedTotal)
+	prometheus.MustRegister(connectionsDeadTotal)
+	prometheus.MustRegister(acquireWait)
+	prometheus.MustRegister(acquireFailuresTotal)
+	prometheus.MustRegister(poolsCreatedTotal)
+	prometheus.MustRegister(poolsRemovedTotal)
+	prometheus.MustRegister(registrationsRejectedTotal)
+	prometheus.MustRegister(clientRequestsTotal)
+	prometheus.MustRegister(clientsRejectedTotal)
+	prometheus.MustRegister(clientsDeniedTotal)
+}
+
+// Describe implements prometheus.Collector
+func (i *Isolator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+	ch <- poolQueueLengthDesc
+	ch <- poolStreamsDesc
+}
+
+// Collect implements prometheus.Collector, pool gauges are computed from the stats at scrape time
+func (i *Isolator) Collect(ch chan<- prometheus.Metric) {
+	for _, ps := range i.Stats().Pools {
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(ps.Idle), ps.Name, "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(len(ps.Connections)-ps.Idle), ps.Name, "in-flight")
+		ch <- prometheus.MustNewConstMetric(poolStreamsDesc, prometheus.GaugeValue, float64(ps.InFlight), ps.Name)
+		ch <- prometheus.MustNewConstMetric(poolQueueLengthDesc, prometheus.GaugeValue, float64(ps.Queued), ps.Name)
+	}
+}
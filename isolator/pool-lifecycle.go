@@ -0,0 +1,75 @@
+package isolator
+
+import (
+	"log"
+	"time"
+)
+
+// Number of pool events kept for the stats
+const maxPoolEvents = 100
+
+// PoolEvent records a change in the set of pools
+type PoolEvent struct {
+	Time   time.Time `json:"time"`
+	Pool   string    `json:"pool"`
+	Event  string    `json:"event"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// addPool creates a new pool, i.lock must be held
+func (i *Isolator) addPool(name string) (pool *ProxyPool) {
+	pool = NewProxyPool(name, i.config.PoolSize, i.config.QueueSize)
+	i.pools[name] = pool
+	i.poolsNames = append(i.poolsNames, name)
+
+	log.Printf("Pool %s created", name)
+	poolsCreatedTotal.Inc()
+	i.addPoolEvent(name, "created", "")
+	return
+}
+
+// removePool forgets a pool so that it is not selected anymore, i.lock must be held
+func (i *Isolator) removePool(name string, reason string) {
+	delete(i.pools, name)
+	filtered := i.poolsNames[:0]
+	for _, n := range i.poolsNames {
+		if n != name {
+			filtered = append(filtered, n)
+		}
+	}
+	i.poolsNames = filtered
+
+	log.Printf("Pool %s removed : %s", name, reason)
+	poolsRemovedTotal.Inc()
+	i.addPoolEvent(name, "removed", reason)
+}
+
+// addPoolEvent keeps the latest maxPoolEvents events, i.lock must be held
+func (i *Isolator) addPoolEvent(name string, event string, reason string) {
+	i.poolEvents = append(i.poolEvents, &PoolEvent{Time: time.Now(), Pool: name, Event: event, Reason: reason})
+	if len(i.poolEvents) > maxPoolEvents {
+		i.poolEvents = i.poolEvents[len(i.poolEvents)-maxPoolEvents:]
+	}
+}
+
+// purgePools removes the pools without any live connection for more than the grace period
+func (i *Isolator) purgePools() {
+	grace := time.Duration(i.config.PoolGracePeriod)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for name, pool := range i.pools {
+		since := pool.EmptySince()
+		if !since.IsZero() && time.Since(since) >= grace {
+			i.removePool(name, "no live connection since "+since.Format(time.RFC3339))
+		}
+	}
+}
+
+// poolJanitor purges the empty pools every second
+func (i *Isolator) poolJanitor() {
+	for range time.Tick(time.Second) {
+		i.purgePools()
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"net/http"
 	"log"
 	"io"
-	"encoding/json"
 	"fmt"
 
 	"github.com/gorilla/websocket"
 	"github.com/root-gg/isolator/common"
-	"io/ioutil"
 	"sync"
+	"sync/atomic"
+	"strconv"
+	"time"
 )
 
 const (
@@ -21,147 +22,201 @@ const (
 
 type ProxyConnection struct {
 	pp *ProxyPool
-	ws *websocket.Conn
+	session *common.Session
 
+	// IDLE when no stream is in progress
 	status int
+	streams int
+	maxStreams int
+	// The connection is out of the pool because it can't carry more streams
+	// or because the pool was full, it is offered again when a stream is released
+	full bool
 	lock sync.Mutex
 
-	nextResponse      chan(chan(io.Reader))
+	registered time.Time
+	// Number of streams opened and time of the last one
+	uses int64
+	lastUsed time.Time
+	greeting *common.Greeting
+	counters Counters
 }
 
-func NewProxyConnection(pp *ProxyPool, ws *websocket.Conn) (pc *ProxyConnection){
+func NewProxyConnection(pp *ProxyPool, ws *websocket.Conn, greeting *common.Greeting) (pc *ProxyConnection){
 	pc = new(ProxyConnection)
 	pc.pp = pp
-	pc.ws = ws
-	pc.nextResponse = make(chan(chan(io.Reader)))
-
-	go pc.read()
+	pc.greeting = greeting
+	pc.registered = time.Now()
+	pc.maxStreams = greeting.MaxStreams
+	if pc.maxStreams <= 0 {
+		pc.maxStreams = 1
+	}
 
-	return
-}
+	// Only the isolator opens streams
+	pc.session = common.NewSession(ws, nil)
 
-func (pc *ProxyConnection) read(){
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Websocket crash recovered : %s", r)
-		}
+	go func() {
+		<-pc.session.Done()
 		pc.Close()
 	}()
 
-	for {
-		if pc.status == CLOSED {
-			break
-		}
+	return
+}
 
-		// https://godoc.org/github.com/gorilla/websocket#hdr-Control_Messages
-		//
-		// We need to ensure :
-		//  - no concurrent calls to ws.NextReader() / ws.ReadMessage()
-		//  - only one reader exists at a time
-		//  - wait for reader to be consumed before requesting the next one
-		//  - always be reading on the socket to be able to process control messages ( ping / pong / close )
+// Open starts a new stream on the connection. The connection is offered back to the pool
+// right away if it can carry more streams, otherwise once a stream is released.
+func (pc *ProxyConnection) Open() (stream *common.Stream, err error) {
+	pc.lock.Lock()
+	if pc.status == CLOSED {
+		pc.lock.Unlock()
+		return nil, fmt.Errorf("Proxy connection is closed")
+	}
+	if pc.streams >= pc.maxStreams {
+		pc.lock.Unlock()
+		return nil, fmt.Errorf("Proxy connection is full")
+	}
 
-		// We will block here until a message is received or the ws is closed
-		_, reader, err := pc.ws.NextReader()
-		if err != nil {
-			pc.Close()
-			return
-		}
+	stream, err = pc.session.Open()
+	if err != nil {
+		pc.lock.Unlock()
+		return nil, err
+	}
 
-		if pc.status != PROXY {
-			// We received a wild unexpected message
-			break
-		}
+	pc.streams++
+	pc.uses++
+	pc.lastUsed = time.Now()
+	pc.status = PROXY
+	available := pc.streams < pc.maxStreams
+	if !available {
+		pc.full = true
+	}
+	pc.lock.Unlock()
 
-		// We received a message from the proxy
-		// It is expected to be either a HttpResponse or a HttpResponseBody
-		// We wait for proxyRequest to send a channel to get the message
-		c := <-pc.nextResponse
-		if c == nil {
-			// We have been unlocked by Close()
-			break
-		}
+	if available {
+		pc.pp.Offer(pc)
+	}
+	return
+}
 
-		// Send the reader back to proxyRequest
-		c <- reader
+// release must be called once a stream returned by Open is done
+func (pc *ProxyConnection) release() {
+	pc.lock.Lock()
+	pc.streams--
+	if pc.streams == 0 && pc.status == PROXY {
+		pc.status = IDLE
+	}
+	offer := pc.full && pc.status != CLOSED
+	pc.full = false
+	pc.lock.Unlock()
 
-		// Wait for proxyRequest to close the channel
-		// this notify that it is done with the reader
-		<-c
+	if offer {
+		pc.pp.Offer(pc)
 	}
 }
 
-func (pc *ProxyConnection) proxyRequest(w http.ResponseWriter, r *http.Request) (err error){
-	if pc.status != IDLE {
-		return fmt.Errorf("Proxy connection is not READY")
+// park keeps a connection that the full pool can't take back out of the pool until
+// one of its streams is released, it returns false if the connection is idle
+func (pc *ProxyConnection) park() bool {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.streams == 0 {
+		return false
 	}
-	pc.status = PROXY
+	pc.full = true
+	return true
+}
 
-	log.Printf("proxy request to %s", pc.pp.name)
+func (pc *ProxyConnection) proxyRequest(stream *common.Stream, w http.ResponseWriter, r *http.Request, timeouts common.Timeouts, noRedirect bool) (err error){
+	defer pc.release()
 
-	// Serialize request
-	jsonReq, err := json.Marshal(common.SerializeHttpRequest(r))
-	if err != nil {
-		return fmt.Errorf("Unable to serialize request : %s",err)
-	}
+	atomic.AddInt64(&pc.counters.Requests, 1)
+
+	start := time.Now()
+	code := "error"
+	defer func() {
+		if err != nil && r.Context().Err() != nil {
+			code = "canceled"
+		} else if err != nil {
+			atomic.AddInt64(&pc.counters.Errors, 1)
+		}
+		requestsTotal.WithLabelValues(pc.pp.name, code).Inc()
+		requestDuration.WithLabelValues(pc.pp.name).Observe(time.Since(start).Seconds())
+	}()
 
-	log.Printf("write request")
+	log.Printf("proxy request to %s ( stream %d )", pc.pp.name, stream.ID)
 
 	// Send serialized request to the proxy
-	err = pc.ws.WriteMessage(websocket.TextMessage,jsonReq)
+	httpRequest := common.SerializeHttpRequest(r)
+	httpRequest.Timeouts = timeouts
+	httpRequest.NoRedirect = noRedirect
+	err = stream.WriteHead(common.FrameRequest,httpRequest)
 	if err != nil {
+		stream.Reset()
 		return fmt.Errorf("Unable to write request : %s",err)
 	}
 
-	log.Printf("write request body")
-
-	// Send the request body to the proxy
-	bodyWriter, err := pc.ws.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		return fmt.Errorf("Unable to get request body writer : %s",err)
-	}
-	_, err = io.Copy(bodyWriter,r.Body)
-	if err != nil {
-		return fmt.Errorf("Unable to pipe request body : %s",err)
-	}
-
-	err = bodyWriter.Close()
-	if err != nil {
-		return fmt.Errorf("Unable to pipe request body (close) : %s",err)
-	}
+	// Cancel the request on the proxy if the client goes away
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			stream.Cancel()
+		case <-finished:
+		}
+	}()
 
-	log.Printf("read response")
+	// Send the request body to the proxy while waiting for the response
+	bodyDone := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(stream,r.Body)
+		atomic.AddInt64(&pc.counters.BytesOut, n)
+		bodyBytesTotal.WithLabelValues(pc.pp.name, "out").Add(float64(n))
+		if err != nil {
+			bodyDone <- fmt.Errorf("Unable to pipe request body : %s",err)
+			return
+		}
+		bodyDone <- stream.CloseWrite()
+	}()
 
-	// Send a new channel to read() to get the next message reader
-	// which is expected to be the serialized response
-	responseChannel := make(chan(io.Reader))
-	pc.nextResponse <- responseChannel
-	responseReader, more := <- responseChannel
-	if responseReader == nil {
-		if more {
-			// If more is false the channel is already closed
-			close(responseChannel)
+	// The request body must be sent before returning, the stream is reset
+	// on error to release a body write blocked on the flow control window
+	defer func() {
+		if err != nil {
+			stream.Reset()
 		}
-		return fmt.Errorf("Unable to get http response reader : %s",err)
-	}
+		if e := <-bodyDone; e != nil && err == nil {
+			stream.Reset()
+			err = e
+		}
+	}()
 
-	jsonResponse, err := ioutil.ReadAll(responseReader)
+	// Read the serialized response
+	frame, err := stream.ReadFrame()
 	if err != nil {
-		close(responseChannel)
 		return fmt.Errorf("Unable to read http response : %s",err)
 	}
-
-	// Notify read() that we are done reading the serialized response
-	close(responseChannel)
+	if frame.Type == common.FrameError {
+		// The proxy was unable to execute the request
+		proxyError := new(common.ProxyError)
+		err = proxyError.UnmarshalBinary(frame.Payload)
+		if err != nil {
+			return fmt.Errorf("Unable to unserialize proxy error : %s",err)
+		}
+		return proxyError
+	}
+	if frame.Type != common.FrameResponse {
+		return fmt.Errorf("Unexpected frame type %d instead of http response",frame.Type)
+	}
 
 	// Unserialize response
 	httpResponse := new(common.HttpResponse)
-	err = json.Unmarshal(jsonResponse, httpResponse)
+	err = httpResponse.UnmarshalBinary(frame.Payload)
 	if err != nil {
 		return fmt.Errorf("Unable to unserialize http response : %s",err)
 	}
-
-	log.Printf("write response")
+	upstreamLatency.WithLabelValues(pc.pp.name).Observe(time.Since(start).Seconds())
+	code = strconv.Itoa(httpResponse.StatusCode)
 
 	// Write response headers to the client
 	for header, values := range httpResponse.Header {
@@ -171,51 +226,54 @@ func (pc *ProxyConnection) proxyRequest(w http.ResponseWriter, r *http.Request)
 	}
 	w.WriteHeader(httpResponse.StatusCode)
 
-	log.Printf("read response body")
-
-	// Send a new channel to read() to get the next message reader
-	// which is expected to be the response body ( binary )
-	responseBodyChannel := make(chan(io.Reader))
-	pc.nextResponse <- responseBodyChannel
-	responseBodyReader, more := <- responseBodyChannel
-	if responseBodyReader == nil {
-		if more {
-			// If more is false the channel is already closed
-			close(responseChannel)
-		}
-		return fmt.Errorf("Unable to get http response body reader : %s",err)
-	}
-
-	log.Printf("write response body")
-
 	// Pipe the response body from the proxy to the client
-	_, err = io.Copy(w,responseBodyReader)
+	n, err := io.Copy(w,stream)
+	atomic.AddInt64(&pc.counters.BytesIn, n)
+	bodyBytesTotal.WithLabelValues(pc.pp.name, "in").Add(float64(n))
 	if err != nil {
-		close(responseBodyChannel)
 		return fmt.Errorf("Unable to pipe response body : %s",err)
 	}
 
-	// Notify read() that we are done reading the response body
-	close(responseBodyChannel)
-
-	log.Printf("yata")
-
-	pc.status = IDLE
 	return
 }
 
 func (pc *ProxyConnection) Close(){
 	pc.lock.Lock()
-	defer pc.lock.Unlock()
-
 	if pc.status == CLOSED {
+		pc.lock.Unlock()
 		return
 	}
+	pc.status = CLOSED
+	pc.lock.Unlock()
 
 	log.Printf("Closing connection from %s", pc.pp.name)
-	pc.ws.Close()
+	pc.session.Close()
+	connectionsClosedTotal.WithLabelValues(pc.pp.name).Inc()
+	if pc.session.Err() == common.ErrDeadPeer {
+		log.Printf("Proxy connection from %s is dead", pc.pp.name)
+		connectionsDeadTotal.WithLabelValues(pc.pp.name).Inc()
+	}
 
-	// Unlock a possible read
-	close(pc.nextResponse)
-	pc.status = CLOSED
-}
\ No newline at end of file
+	pc.pp.Remove(pc)
+}
+
+// Status returns IDLE, PROXY or CLOSED
+func (pc *ProxyConnection) Status() int {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	return pc.status
+}
+
+// Age returns the time since the connection has been registered
+func (pc *ProxyConnection) Age() time.Duration {
+	return time.Since(pc.registered)
+}
+
+// Streams returns the number of streams in progress
+func (pc *ProxyConnection) Streams() int {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	return pc.streams
+}
@@ -1,49 +1,301 @@
 package isolator
 
 import (
-	"time"
+	"context"
 	"errors"
+	"time"
 	"github.com/gorilla/websocket"
 	"log"
+	"sync"
+
+	"github.com/root-gg/isolator/common"
 )
 
 type ProxyPool struct {
 	name string
-	pool chan(*ProxyConnection)
+
+	// Connections that can carry more streams, oldest offered first
+	available []*ProxyConnection
+	size int
+	// Take calls waiting for a connection, oldest first
+	waiters []chan *ProxyConnection
+	queueSize int
+
+	created time.Time
+	connections []*ProxyConnection
+	closed int64
+	// Connections closed because the proxy did not answer the heartbeat
+	dead int64
+	// When the last connection has been removed, zero if the pool has live connections
+	emptySince time.Time
+	history Counters
+	lock sync.Mutex
+
+	// Latest greeting of each proxy instance
+	instances map[string]*common.Greeting
+	// Labels shared by all the instances
+	labels map[string]string
 }
 
-func NewProxyPool(name string) (pp *ProxyPool) {
+// ErrQueueFull is returned by Take when too many requests are already waiting
+var ErrQueueFull = errors.New("too many requests waiting for a proxy connection")
+
+func NewProxyPool(name string, size int, queueSize int) (pp *ProxyPool) {
 	pp = new(ProxyPool)
 	pp.name = name
-	pp.pool = make(chan *ProxyConnection,1000)
+	pp.available = make([]*ProxyConnection,0)
+	pp.size = size
+	pp.queueSize = queueSize
+	pp.created = time.Now()
+	pp.connections = make([]*ProxyConnection,0)
+	pp.instances = make(map[string]*common.Greeting)
+	pp.labels = make(map[string]string)
 
 	return
 }
 
-func (pp *ProxyPool) Register(ws *websocket.Conn) {
-	log.Printf("Registering new connection from %s",pp.name)
-	pc := NewProxyConnection(pp,ws)
+func (pp *ProxyPool) Register(ws *websocket.Conn, greeting *common.Greeting) (pc *ProxyConnection) {
+	log.Printf("Registering new connection from %s ( %s )",pp.name,greeting.InstanceID)
+	pc = NewProxyConnection(pp,ws,greeting)
+	connectionsRegisteredTotal.WithLabelValues(pp.name).Inc()
+
+	pp.lock.Lock()
+	pp.connections = append(pp.connections,pc)
+	pp.emptySince = time.Time{}
+	pp.instances[greeting.InstanceID] = greeting
+	pp.updateLabels()
+	pp.lock.Unlock()
+
 	pp.Offer(pc)
+	return
 }
 
+// Remove forgets a closed connection so that it can't be taken anymore,
+// its counters are kept in the pool history
+func (pp *ProxyPool) Remove(pc *ProxyConnection) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	filtered := pp.connections[:0]
+	for _, c := range pp.connections {
+		if pc != c {
+			filtered = append(filtered, c)
+		}
+	}
+	if len(filtered) == len(pp.connections) {
+		return
+	}
+	pp.connections = filtered
+
+	available := pp.available[:0]
+	for _, c := range pp.available {
+		if pc != c {
+			available = append(available, c)
+		}
+	}
+	pp.available = available
+
+	pp.closed++
+	if len(pp.connections) == 0 {
+		log.Printf("Pool %s has no live connection anymore", pp.name)
+		pp.emptySince = time.Now()
+	}
+	if pc.session.Err() == common.ErrDeadPeer {
+		pp.dead++
+	}
+	pp.history.Add(pc.counters.Snapshot())
+
+	// Forget the instance once its last connection is gone
+	for _, c := range pp.connections {
+		if c.greeting.InstanceID == pc.greeting.InstanceID {
+			return
+		}
+	}
+	delete(pp.instances, pc.greeting.InstanceID)
+	pp.updateLabels()
+}
+
+// updateLabels sets the pool labels to the ones all the instances agree on so that
+// selectors don't depend on the registration order. They are kept when the last
+// instance goes away so that requests can still wait for the pool to come back.
+func (pp *ProxyPool) updateLabels() {
+	if len(pp.instances) == 0 {
+		return
+	}
+
+	labels := make(map[string]string)
+	first := true
+	for _, greeting := range pp.instances {
+		if first {
+			for key, value := range greeting.Labels {
+				labels[key] = value
+			}
+			first = false
+			continue
+		}
+		for key, value := range labels {
+			if v, ok := greeting.Labels[key]; !ok || v != value {
+				delete(labels, key)
+			}
+		}
+	}
+	pp.labels = labels
+}
+
+// Live returns the number of connections that have not been closed
+func (pp *ProxyPool) Live() int {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	return len(pp.connections)
+}
+
+// EmptySince returns when the last connection of the pool has been removed,
+// or the zero time if the pool has live connections
+func (pp *ProxyPool) EmptySince() time.Time {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	return pp.emptySince
+}
+
+// Queued returns the number of requests waiting for a connection
+func (pp *ProxyPool) Queued() int {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	return len(pp.waiters)
+}
+
+// Matches returns true if the pool has all the selector labels
+func (pp *ProxyPool) Matches(selector map[string]string) bool {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	for key, value := range selector {
+		if v, ok := pp.labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// InFlight returns the number of requests in progress
+func (pp *ProxyPool) InFlight() (n int) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	for _, pc := range pp.connections {
+		n += pc.Streams()
+	}
+	return
+}
+
+// Capacity returns the sum of the capacities advertised by the proxies
+func (pp *ProxyPool) Capacity() (n int) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	for _, greeting := range pp.instances {
+		n += greeting.Capacity
+	}
+	return
+}
+
+// Offer makes a connection that can carry more streams available, it is handed to
+// the oldest waiting Take if any. If the pool is full an idle connection is closed,
+// a connection still carrying streams is offered again once one of them is released.
 func (pp *ProxyPool) Offer(pc *ProxyConnection) {
-	pp.pool <- pc
+	pp.lock.Lock()
+	if pc.Status() == CLOSED {
+		pp.lock.Unlock()
+		return
+	}
+
+	if len(pp.waiters) > 0 {
+		waiter := pp.waiters[0]
+		pp.waiters = pp.waiters[1:]
+		pp.lock.Unlock()
+		waiter <- pc
+		return
+	}
+
+	if len(pp.available) >= pp.size {
+		if pc.park() {
+			pp.lock.Unlock()
+			return
+		}
+		pp.lock.Unlock()
+		log.Printf("Pool %s is full, closing connection", pp.name)
+		pc.Close()
+		return
+	}
+
+	pp.available = append(pp.available, pc)
+	pp.lock.Unlock()
 }
 
-func (pp *ProxyPool) Take() (*ProxyConnection){
+// TryTake returns an available connection or nil without waiting
+func (pp *ProxyPool) TryTake() *ProxyConnection {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	return pp.next()
+}
+
+// Take returns an available connection, waiting for one to be offered until ctx is done.
+// Callers are served in their arrival order, ErrQueueFull is returned if too many are waiting.
+func (pp *ProxyPool) Take(ctx context.Context) (pc *ProxyConnection, err error) {
+	pp.lock.Lock()
+	pc = pp.next()
+	if pc != nil {
+		pp.lock.Unlock()
+		return
+	}
+
+	if len(pp.waiters) >= pp.queueSize {
+		pp.lock.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	waiter := make(chan *ProxyConnection, 1)
+	pp.waiters = append(pp.waiters, waiter)
+	pp.lock.Unlock()
+
 	select {
-	case pc := <-pp.pool:
-		return pc
+	case pc = <-waiter:
+		return pc, nil
+	case <-ctx.Done():
+	}
+
+	pp.lock.Lock()
+	for i, w := range pp.waiters {
+		if w == waiter {
+			pp.waiters = append(pp.waiters[:i], pp.waiters[i+1:]...)
+			break
+		}
+	}
+	pp.lock.Unlock()
+
+	// A connection might have been handed over in the meantime
+	select {
+	case pc = <-waiter:
+		pp.Offer(pc)
 	default:
-		return nil
 	}
+
+	return nil, ctx.Err()
 }
 
-func (pp *ProxyPool) TakeWithTimeout(d time.Duration) (p *ProxyConnection, err error){
-	select {
-	case p = <- pp.pool:
-	case <- time.After(d):
-		err = errors.New("timeout")
+// next pops the first connection of the available list, pp.lock must be held
+func (pp *ProxyPool) next() (pc *ProxyConnection) {
+	for len(pp.available) > 0 {
+		pc = pp.available[0]
+		pp.available[0] = nil
+		pp.available = pp.available[1:]
+		if pc.Status() != CLOSED {
+			return pc
+		}
 	}
-	return
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,117 @@
+package isolator
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/root-gg/isolator/common"
+)
+
+// newTestAgent starts a websocket server echoing the data of every stream
+// and returns a new connection to it
+func newTestAgent(t *testing.T) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		common.NewSession(ws, func(stream *common.Stream) {
+			_, err := stream.ReadFrame()
+			if err != nil {
+				return
+			}
+			io.Copy(stream, stream)
+			stream.CloseWrite()
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unable to dial test agent : %s", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// openEcho opens a stream and sends data without closing it
+func openEcho(t *testing.T, pc *ProxyConnection, data []byte) *common.Stream {
+	stream, err := pc.Open()
+	if err != nil {
+		t.Fatalf("Unable to open stream : %s", err)
+	}
+	err = stream.WriteFrame(common.FrameTunnel, nil)
+	if err != nil {
+		t.Fatalf("Unable to write head : %s", err)
+	}
+	_, err = stream.Write(data)
+	if err != nil {
+		t.Fatalf("Unable to write data : %s", err)
+	}
+	return stream
+}
+
+// finishEcho closes the stream and checks the echoed data
+func finishEcho(t *testing.T, stream *common.Stream, data []byte) {
+	err := stream.CloseWrite()
+	if err != nil {
+		t.Fatalf("Unable to close stream %d : %s", stream.ID, err)
+	}
+	echo, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Unable to read stream %d : %s", stream.ID, err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatalf("Stream %d echoed %q, expected %q", stream.ID, echo, data)
+	}
+}
+
+func TestProxyPoolConcurrentStreams(t *testing.T) {
+	pp := NewProxyPool("test", 1, 10)
+	greeting := &common.Greeting{InstanceID: "a", MaxStreams: 2}
+	pc := pp.Register(newTestAgent(t), greeting)
+
+	// The connection is offered back after the first stream and full after the second
+	if pp.TryTake() != pc {
+		t.Fatalf("Expected the registered connection")
+	}
+	first := openEcho(t, pc, []byte("first"))
+	if pp.TryTake() != pc {
+		t.Fatalf("Expected the connection to carry a second stream")
+	}
+	second := openEcho(t, pc, []byte("second"))
+	if pp.TryTake() != nil {
+		t.Fatalf("Expected the connection to be full")
+	}
+
+	// Another connection fills the pool
+	other := pp.Register(newTestAgent(t), &common.Greeting{InstanceID: "b", MaxStreams: 2})
+
+	// Releasing a stream while the pool is full must not close the other one
+	finishEcho(t, first, []byte("first"))
+	pc.release()
+	if pc.Status() == CLOSED {
+		t.Fatalf("Connection closed while carrying a stream")
+	}
+	if pp.Live() != 2 {
+		t.Fatalf("Expected 2 live connections, got %d", pp.Live())
+	}
+
+	finishEcho(t, second, []byte("second"))
+	pc.release()
+
+	// Once idle the connection is closed because the pool is still full
+	if pc.Status() != CLOSED {
+		t.Fatalf("Expected the idle connection to be closed")
+	}
+	if pp.TryTake() != other {
+		t.Fatalf("Expected the other connection to be available")
+	}
+}
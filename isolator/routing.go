@@ -0,0 +1,100 @@
+package isolator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// PoolHeader lets clients choose the pools ( comma separated names ) a request can go out of
+const PoolHeader = "X-PROXY-POOL"
+
+// PoolSelectorHeader restricts the pools to the ones having all the given labels ( key=value,key=value )
+const PoolSelectorHeader = "X-PROXY-POOL-SELECTOR"
+
+// AcquireTimeoutHeader lets clients choose how long to wait for an available proxy connection ( ex : 10s )
+const AcquireTimeoutHeader = "X-PROXY-ACQUIRE-TIMEOUT"
+
+// acquireTimeout returns how long a request can wait for an available connection
+func (i *Isolator) acquireTimeout(r *http.Request) (timeout time.Duration, err error) {
+	value := r.Header.Get(AcquireTimeoutHeader)
+	r.Header.Del(AcquireTimeoutHeader)
+
+	if value == "" {
+		return time.Duration(i.config.AcquireTimeout), nil
+	}
+
+	timeout, err = time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid %s header %q", AcquireTimeoutHeader, value)
+	}
+	if max := time.Duration(i.config.MaxAcquireTimeout); timeout > max {
+		timeout = max
+	}
+	return
+}
+
+// selectPools returns the pools a request can be proxied through
+func (i *Isolator) selectPools(r *http.Request) (pools []*ProxyPool, err error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	value := r.Header.Get(PoolHeader)
+	r.Header.Del(PoolHeader)
+
+	var selector common.StringMap
+	if v := r.Header.Get(PoolSelectorHeader); v != "" {
+		err = selector.Set(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s header : %s", PoolSelectorHeader, err)
+		}
+	}
+	r.Header.Del(PoolSelectorHeader)
+
+	candidates := make([]*ProxyPool, 0)
+	if value == "" {
+		for _, name := range i.poolsNames {
+			candidates = append(candidates, i.pools[name])
+		}
+	} else {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			pool, ok := i.pools[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown proxy pool %s", name)
+			}
+			candidates = append(candidates, pool)
+		}
+
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("Invalid %s header", PoolHeader)
+		}
+	}
+
+	pools = make([]*ProxyPool, 0, len(candidates))
+	for _, pool := range candidates {
+		if pool.Matches(selector) {
+			pools = append(pools, pool)
+		}
+	}
+
+	if len(pools) == 0 && len(selector) > 0 {
+		return nil, fmt.Errorf("No proxy pool matches %s", selector)
+	}
+
+	return
+}
+
+func poolNames(pools []*ProxyPool) string {
+	names := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		names = append(names, pool.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,364 @@
+package isolator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// SOCKS5 protocol ( RFC 1928 ) and username/password authentication ( RFC 1929 )
+const (
+	socksVersion         = 0x05
+	socksPasswordVersion = 0x01
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyFailure             = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// Maximum duration of the SOCKS5 negotiation when no read timeout is configured
+const socksHandshakeTimeout = 30 * time.Second
+
+// serveSocks accepts the SOCKS5 clients of a listener
+func (i *Isolator) serveSocks(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %s : %s", address, err)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go i.socks(conn)
+	}
+}
+
+// socks negotiates a SOCKS5 CONNECT, the tunnel then goes through the same
+// routing, ACLs and proxies as the HTTP CONNECT requests
+func (i *Isolator) socks(conn net.Conn) {
+	defer conn.Close()
+
+	timeout := time.Duration(i.config.ReadTimeout)
+	if timeout == 0 {
+		timeout = socksHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	reader := bufio.NewReader(conn)
+	identity, err := i.socksAuthenticate(conn, reader)
+	if err != nil {
+		log.Printf("Rejected SOCKS client %s : %s", conn.RemoteAddr(), err)
+		clientsRejectedTotal.Inc()
+		return
+	}
+
+	address, code, err := readSocksRequest(reader)
+	if err != nil {
+		log.Printf("Invalid SOCKS request from %s : %s", conn.RemoteAddr(), err)
+		writeSocksReply(conn, code, nil)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The tunnel is handled as an HTTP CONNECT request, it is canceled if the
+	// client goes away before the tunnel is established
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &socksResponseWriter{conn: conn, reader: reader, header: make(http.Header)}
+	w.watch(cancel)
+	defer w.stopWatching()
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: address},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       address,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("X-PROXY-DESTINATION", "tcp://"+address)
+	if len(i.config.SocksPools) > 0 {
+		r.Header.Set(PoolHeader, strings.Join(i.config.SocksPools, ","))
+	}
+
+	i.handle(w, r, identity)
+}
+
+// socksAuthenticate negotiates the authentication method, clients must send
+// the username and password of a basic client key if authentication is enabled.
+// Every client is rejected if the basic method is not in the configured ones.
+func (i *Isolator) socksAuthenticate(conn net.Conn, reader *bufio.Reader) (identity *Identity, err error) {
+	header := make([]byte, 2)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(reader, methods)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(socksAuthNone)
+	if i.clientKeys != nil {
+		method = socksAuthPassword
+	}
+	if method == socksAuthPassword && !i.config.ClientAuth.Contains("basic") {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return nil, fmt.Errorf("basic client authentication is disabled")
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return nil, fmt.Errorf("no acceptable authentication method")
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return nil, err
+	}
+
+	if method == socksAuthNone {
+		return anonymous, nil
+	}
+
+	// ver | ulen | username | plen | password
+	version, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != socksPasswordVersion {
+		return nil, fmt.Errorf("unsupported authentication version %d", version)
+	}
+	username, err := readSocksString(reader)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSocksString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	identity = i.clientKeys.lookup("basic", username, password)
+	if identity == nil {
+		conn.Write([]byte{socksPasswordVersion, 0x01})
+		return nil, fmt.Errorf("invalid username or password for %s", username)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, 0x00})
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// readSocksRequest returns the host:port of a CONNECT request,
+// or the reply code to send if the request is invalid
+func readSocksRequest(reader *bufio.Reader) (address string, code byte, err error) {
+	// ver | cmd | rsv | atyp
+	header := make([]byte, 4)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return "", socksReplyFailure, err
+	}
+	if header[0] != socksVersion {
+		return "", socksReplyFailure, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCommandConnect {
+		return "", socksReplyCommandNotSupported, fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		host = ip.String()
+	case socksAddressDomain:
+		host, err = readSocksString(reader)
+	default:
+		return "", socksReplyAddressNotSupported, fmt.Errorf("unsupported address type %d", header[3])
+	}
+	if err != nil {
+		return "", socksReplyFailure, err
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(reader, port)
+	if err != nil {
+		return "", socksReplyFailure, err
+	}
+
+	address = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return address, socksReplySucceeded, nil
+}
+
+// readSocksString reads a string prefixed by its length on one byte
+func readSocksString(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// writeSocksReply sends the reply of a request, the bound address is 0.0.0.0:0 if nil
+func writeSocksReply(conn net.Conn, code byte, bound *net.TCPAddr) error {
+	if bound == nil {
+		bound = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	// ver | rep | rsv | atyp | bnd.addr | bnd.port
+	reply := []byte{socksVersion, code, 0x00}
+	if ip := bound.IP.To4(); ip != nil {
+		reply = append(reply, socksAddressIPv4)
+		reply = append(reply, ip...)
+	} else {
+		reply = append(reply, socksAddressIPv6)
+		reply = append(reply, bound.IP.To16()...)
+	}
+	reply = append(reply, byte(bound.Port>>8), byte(bound.Port))
+
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksReplyCode maps the HTTP errors of the isolator to SOCKS5 reply codes
+func socksReplyCode(status int, class string) byte {
+	switch class {
+	case common.ErrorPolicyDenied:
+		return socksReplyNotAllowed
+	case common.ErrorDNS, common.ErrorTimeout:
+		return socksReplyHostUnreachable
+	case common.ErrorConnect:
+		return socksReplyConnectionRefused
+	}
+	if status == 403 {
+		// Denied by the client ACLs
+		return socksReplyNotAllowed
+	}
+	return socksReplyFailure
+}
+
+// socksResponseWriter lets the SOCKS5 tunnels go through Isolator.handle,
+// error responses are sent as SOCKS5 replies and their body is discarded
+type socksResponseWriter struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	header  http.Header
+	replied bool
+
+	// Closed to stop watching the client connection, then closed by the watcher
+	stopping chan struct{}
+	watching chan struct{}
+	stopped  sync.Once
+}
+
+// watch cancels the request if the client connection is closed. Early bytes sent
+// by the client are kept in the reader buffer and relayed once the tunnel is established.
+func (w *socksResponseWriter) watch(cancel context.CancelFunc) {
+	w.stopping = make(chan struct{})
+	w.watching = make(chan struct{})
+	go func() {
+		defer close(w.watching)
+
+		_, err := w.reader.Peek(1)
+		select {
+		case <-w.stopping:
+		default:
+			if err != nil {
+				log.Printf("SOCKS client %s went away : %s", w.conn.RemoteAddr(), err)
+				cancel()
+			}
+		}
+	}()
+}
+
+// stopWatching interrupts the pending read so that the tunnel gets the connection,
+// it can be called several times
+func (w *socksResponseWriter) stopWatching() {
+	w.stopped.Do(func() {
+		close(w.stopping)
+		w.conn.SetReadDeadline(time.Unix(1, 0))
+		<-w.watching
+		w.conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (w *socksResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *socksResponseWriter) Write(p []byte) (int, error) {
+	if !w.replied {
+		w.WriteHeader(200)
+	}
+	return len(p), nil
+}
+
+func (w *socksResponseWriter) WriteHeader(status int) {
+	if w.replied {
+		return
+	}
+	w.replied = true
+
+	var code byte = socksReplySucceeded
+	if status != 200 {
+		code = socksReplyCode(status, w.header.Get(common.ErrorHeader))
+	}
+	writeSocksReply(w.conn, code, nil)
+}
+
+func (w *socksResponseWriter) hijackTunnel() (net.Conn, *bufio.Reader, error) {
+	w.replied = true
+	w.stopWatching()
+
+	bound, _ := w.conn.LocalAddr().(*net.TCPAddr)
+	err := writeSocksReply(w.conn, socksReplySucceeded, bound)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.conn, w.reader, nil
+}
@@ -0,0 +1,188 @@
+package isolator
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// Counters are updated atomically while requests are proxied
+type Counters struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	Errors   int64 `json:"errors"`
+}
+
+// Snapshot returns a consistent copy of the counters
+func (c *Counters) Snapshot() (s Counters) {
+	s.Requests = atomic.LoadInt64(&c.Requests)
+	s.BytesIn = atomic.LoadInt64(&c.BytesIn)
+	s.BytesOut = atomic.LoadInt64(&c.BytesOut)
+	s.Errors = atomic.LoadInt64(&c.Errors)
+	return
+}
+
+// Add sums other into c
+func (c *Counters) Add(other Counters) {
+	atomic.AddInt64(&c.Requests, other.Requests)
+	atomic.AddInt64(&c.BytesIn, other.BytesIn)
+	atomic.AddInt64(&c.BytesOut, other.BytesOut)
+	atomic.AddInt64(&c.Errors, other.Errors)
+}
+
+type ConnectionStats struct {
+	InstanceID string          `json:"instance_id"`
+	Status     string          `json:"status"`
+	Streams    int             `json:"streams"`
+	MaxStreams int             `json:"max_streams"`
+	Registered time.Time       `json:"registered"`
+	Age        common.Duration `json:"age"`
+	Uses       int64           `json:"uses"`
+	LastUsed   time.Time       `json:"last_used"`
+	Counters
+}
+
+type InstanceStats struct {
+	InstanceID   string            `json:"instance_id"`
+	AgentVersion string            `json:"agent_version"`
+	Capabilities []string          `json:"capabilities"`
+	Labels       map[string]string `json:"labels"`
+	Capacity     int               `json:"capacity"`
+}
+
+type PoolStats struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Connections without any stream
+	Idle int `json:"idle"`
+	// Requests in progress
+	InFlight int `json:"in_flight"`
+	// Requests waiting for a connection
+	Queued      int                `json:"queued"`
+	Closed      int64              `json:"closed"`
+	Dead        int64              `json:"dead"`
+	EmptySince  *time.Time         `json:"empty_since,omitempty"`
+	Labels      map[string]string  `json:"labels"`
+	Instances   []*InstanceStats   `json:"instances"`
+	Connections []*ConnectionStats `json:"connections"`
+	Counters
+}
+
+type IsolatorStats struct {
+	Started time.Time    `json:"started"`
+	Pools   []*PoolStats `json:"pools"`
+	// Latest pools creations and removals
+	Events []*PoolEvent `json:"events"`
+	Counters
+}
+
+func statusString(status int) string {
+	switch status {
+	case IDLE:
+		return "idle"
+	case PROXY:
+		return "in-flight"
+	case CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Stats returns a snapshot of the connection statistics
+func (pc *ProxyConnection) Stats() (cs *ConnectionStats) {
+	cs = new(ConnectionStats)
+	cs.InstanceID = pc.greeting.InstanceID
+	pc.lock.Lock()
+	cs.Status = statusString(pc.status)
+	cs.Streams = pc.streams
+	cs.Uses = pc.uses
+	cs.LastUsed = pc.lastUsed
+	pc.lock.Unlock()
+	cs.Age = common.Duration(pc.Age().Round(time.Second))
+	cs.MaxStreams = pc.maxStreams
+	cs.Registered = pc.registered
+	cs.Counters = pc.counters.Snapshot()
+	return
+}
+
+// Stats returns a snapshot of the pool statistics including
+// the counters of the connections that have already been closed
+func (pp *ProxyPool) Stats() (ps *PoolStats) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	ps = new(PoolStats)
+	ps.Name = pp.name
+	ps.Created = pp.created
+	ps.Closed = pp.closed
+	ps.Dead = pp.dead
+	if !pp.emptySince.IsZero() {
+		emptySince := pp.emptySince
+		ps.EmptySince = &emptySince
+	}
+	ps.Counters = pp.history.Snapshot()
+	ps.Queued = len(pp.waiters)
+	ps.Labels = pp.labels
+	ps.Connections = make([]*ConnectionStats, 0, len(pp.connections))
+
+	ps.Instances = make([]*InstanceStats, 0, len(pp.instances))
+	for _, greeting := range pp.instances {
+		is := new(InstanceStats)
+		is.InstanceID = greeting.InstanceID
+		is.AgentVersion = greeting.AgentVersion
+		is.Capabilities = greeting.Capabilities
+		is.Labels = greeting.Labels
+		is.Capacity = greeting.Capacity
+		ps.Instances = append(ps.Instances, is)
+	}
+	sort.Slice(ps.Instances, func(i, j int) bool {
+		return ps.Instances[i].InstanceID < ps.Instances[j].InstanceID
+	})
+
+	for _, pc := range pp.connections {
+		cs := pc.Stats()
+		if cs.Streams == 0 {
+			ps.Idle++
+		}
+		ps.InFlight += cs.Streams
+		ps.Counters.Add(cs.Counters)
+		ps.Connections = append(ps.Connections, cs)
+	}
+
+	sort.Slice(ps.Connections, func(i, j int) bool {
+		return ps.Connections[i].Registered.Before(ps.Connections[j].Registered)
+	})
+
+	return
+}
+
+// Stats returns a snapshot of all the pools statistics
+func (i *Isolator) Stats() (is *IsolatorStats) {
+	i.lock.RLock()
+	pools := make([]*ProxyPool, 0, len(i.pools))
+	for _, pool := range i.pools {
+		pools = append(pools, pool)
+	}
+	events := make([]*PoolEvent, len(i.poolEvents))
+	copy(events, i.poolEvents)
+	i.lock.RUnlock()
+
+	is = new(IsolatorStats)
+	is.Events = events
+	is.Started = i.started
+	is.Pools = make([]*PoolStats, 0, len(pools))
+	for _, pool := range pools {
+		ps := pool.Stats()
+		is.Counters.Add(ps.Counters)
+		is.Pools = append(is.Pools, ps)
+	}
+
+	sort.Slice(is.Pools, func(i, j int) bool {
+		return is.Pools[i].Name < is.Pools[j].Name
+	})
+
+	return
+}
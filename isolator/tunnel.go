@@ -0,0 +1,150 @@
+package isolator
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// proxyTunnel asks the proxy to connect to the destination of a CONNECT request,
+// then hijacks the client connection and relays the bytes through the stream.
+// Errors happening once the connection is hijacked are only logged.
+func (pc *ProxyConnection) proxyTunnel(stream *common.Stream, w http.ResponseWriter, r *http.Request, timeouts common.Timeouts) (err error) {
+	defer pc.release()
+
+	atomic.AddInt64(&pc.counters.Requests, 1)
+
+	start := time.Now()
+	code := "error"
+	defer func() {
+		if err != nil && r.Context().Err() != nil {
+			code = "canceled"
+		} else if err != nil {
+			atomic.AddInt64(&pc.counters.Errors, 1)
+		}
+		requestsTotal.WithLabelValues(pc.pp.name, code).Inc()
+		requestDuration.WithLabelValues(pc.pp.name).Observe(time.Since(start).Seconds())
+	}()
+
+	log.Printf("proxy tunnel to %s through %s ( stream %d )", r.Host, pc.pp.name, stream.ID)
+
+	hijacker, ok := w.(tunnelHijacker)
+	if !ok {
+		h, ok := w.(http.Hijacker)
+		if !ok {
+			stream.Reset()
+			return fmt.Errorf("Unable to hijack client connection")
+		}
+		hijacker = connectHijacker{h}
+	}
+
+	err = pc.openTunnel(stream, r, &common.TunnelRequest{Address: r.Host, Timeouts: timeouts})
+	if err != nil {
+		return err
+	}
+	upstreamLatency.WithLabelValues(pc.pp.name).Observe(time.Since(start).Seconds())
+
+	conn, reader, err := hijacker.hijackTunnel()
+	if err != nil {
+		stream.Reset()
+		return fmt.Errorf("Unable to hijack client connection : %s", err)
+	}
+	defer conn.Close()
+	code = "tunnel"
+
+	// The client might have sent bytes before the response
+	if n := reader.Buffered(); n > 0 {
+		data, _ := reader.Peek(n)
+		_, err = stream.Write(data)
+		if err != nil {
+			log.Printf("Unable to write tunnel data : %s", err)
+			stream.Reset()
+			return nil
+		}
+		atomic.AddInt64(&pc.counters.BytesOut, int64(n))
+		bodyBytesTotal.WithLabelValues(pc.pp.name, "out").Add(float64(n))
+	}
+
+	// The connection is the client one, what it sends goes out to the destination
+	out, in := common.Relay(stream, conn)
+	atomic.AddInt64(&pc.counters.BytesIn, in)
+	atomic.AddInt64(&pc.counters.BytesOut, out)
+	bodyBytesTotal.WithLabelValues(pc.pp.name, "in").Add(float64(in))
+	bodyBytesTotal.WithLabelValues(pc.pp.name, "out").Add(float64(out))
+
+	log.Printf("tunnel to %s closed ( stream %d )", r.Host, stream.ID)
+	return nil
+}
+
+// tunnelHijacker takes over the client connection of a tunnel and tells
+// the client it is established, the reader holds the bytes already buffered
+type tunnelHijacker interface {
+	hijackTunnel() (net.Conn, *bufio.Reader, error)
+}
+
+// connectHijacker answers HTTP CONNECT requests
+type connectHijacker struct {
+	http.Hijacker
+}
+
+func (h connectHijacker) hijackTunnel() (net.Conn, *bufio.Reader, error) {
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The server timeouts don't apply to the tunnel
+	conn.SetDeadline(time.Time{})
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, buf.Reader, nil
+}
+
+// openTunnel sends the tunnel request and waits for the proxy to be connected
+// to the destination, the stream is canceled if the client goes away meanwhile
+func (pc *ProxyConnection) openTunnel(stream *common.Stream, r *http.Request, tunnelRequest *common.TunnelRequest) (err error) {
+	err = stream.WriteHead(common.FrameTunnel, tunnelRequest)
+	if err != nil {
+		stream.Reset()
+		return fmt.Errorf("Unable to write tunnel request : %s", err)
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			stream.Cancel()
+		case <-finished:
+		}
+	}()
+
+	frame, err := stream.ReadFrame()
+	if err != nil {
+		stream.Reset()
+		return fmt.Errorf("Unable to read tunnel response : %s", err)
+	}
+	if frame.Type == common.FrameError {
+		// The proxy was unable to connect
+		proxyError := new(common.ProxyError)
+		err = proxyError.UnmarshalBinary(frame.Payload)
+		if err != nil {
+			return fmt.Errorf("Unable to unserialize proxy error : %s", err)
+		}
+		return proxyError
+	}
+	if frame.Type != common.FrameTunnel {
+		stream.Reset()
+		return fmt.Errorf("Unexpected frame type %d instead of tunnel response", frame.Type)
+	}
+	return
+}
@@ -5,20 +5,19 @@ import (
 	"os"
 	"os/signal"
 	"log"
-	"github.com/nu7hatch/gouuid"
 )
 
 func main() {
 	// Load configuration
-	config := proxy.NewProxyConfig()
-
-	//config.Name = "localhost"
-	hostname, _ := uuid.NewV4()
-	config.Name = hostname.String()
-
-	config.Targets = append(config.Targets,"ws://localhost:8080/register")
-
-	proxy := proxy.NewProxy(config)
+	config, err := proxy.LoadProxyConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxy, err := proxy.NewProxy(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	/*
  	* Handle SIGINT
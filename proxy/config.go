@@ -1,16 +1,175 @@
 package proxy
 
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
 type ProxyConfig struct {
 	Name string
-	Targets []string
+	Labels common.StringMap
+	Targets common.StringList
 	PoolIdleSize int
 	PoolMaxSize int
+	MaxStreams int
+	MetricsAddress string
+
+	// The isolator is pinged every HeartbeatInterval and the connection is closed
+	// if nothing is received for HeartbeatInterval + HeartbeatTimeout ( 0 = disabled )
+	HeartbeatInterval common.Duration
+	HeartbeatTimeout common.Duration
+
+	// Shared secret to sign the registration on the isolator
+	KeyID string
+	Secret string
+
+	// TLS settings of the connections to the isolator ( wss:// targets )
+	TLSCA string
+	TLSCert string
+	TLSKey string
+
+	// JSON Policy of the destinations the proxy can connect to
+	PolicyFile string
+	// Deny loopback, private and link local ( cloud metadata ) addresses
+	DenyPrivate bool
+
+	// HTTP client settings, the timeouts can be overridden by
+	// the clients with the X-PROXY-TIMEOUT header
+	DialTimeout common.Duration
+	TLSHandshakeTimeout common.Duration
+	ResponseHeaderTimeout common.Duration
+	ClientTimeout common.Duration
+	// Upper bound of the timeouts asked by the clients
+	MaxTimeout common.Duration
+	InsecureSkipVerify bool
+	MaxIdleConnsPerHost int
+	FollowRedirects bool
 }
 
 func NewProxyConfig() (pc *ProxyConfig){
 	pc = new(ProxyConfig)
+	pc.Name, _ = os.Hostname()
+	pc.Labels = make(common.StringMap)
 	pc.Targets = make([]string,0)
-	pc.PoolIdleSize = 10
+	pc.PoolIdleSize = 2
 	pc.PoolMaxSize = 100
+	pc.MaxStreams = 100
+	pc.HeartbeatInterval = common.Duration(15 * time.Second)
+	pc.HeartbeatTimeout = common.Duration(30 * time.Second)
+	pc.MaxIdleConnsPerHost = 2
+	pc.DialTimeout = common.Duration(30 * time.Second)
+	pc.TLSHandshakeTimeout = common.Duration(10 * time.Second)
+	pc.ResponseHeaderTimeout = common.Duration(time.Minute)
+	pc.ClientTimeout = common.Duration(5 * time.Minute)
+	pc.MaxTimeout = common.Duration(30 * time.Minute)
+	pc.FollowRedirects = true
+	pc.DenyPrivate = true
 	return
-}
\ No newline at end of file
+}
+
+// RegisterFlags binds the configuration fields to command line flags
+func (pc *ProxyConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pc.Name, "name", pc.Name, "name of the proxy pool to register in ( defaults to the hostname )")
+	fs.Var(&pc.Labels, "labels", "comma separated key=value labels advertised to the isolator ( ex : region=eu,zone=dmz )")
+	fs.Var(&pc.Targets, "targets", "comma separated list of isolator register URLs ( ex : ws://localhost:8080/register )")
+	fs.IntVar(&pc.PoolIdleSize, "pool-idle-size", pc.PoolIdleSize, "number of connections that can accept more streams to keep open to each target")
+	fs.IntVar(&pc.MaxStreams, "max-streams", pc.MaxStreams, "maximum number of concurrent requests on each connection")
+	fs.IntVar(&pc.PoolMaxSize, "pool-max-size", pc.PoolMaxSize, "maximum number of connections to each target")
+	fs.Var(&pc.HeartbeatInterval, "heartbeat-interval", "interval between two pings of the isolator ( 0 = disabled )")
+	fs.Var(&pc.HeartbeatTimeout, "heartbeat-timeout", "time to wait for a pong before closing a connection")
+	fs.StringVar(&pc.MetricsAddress, "metrics-address", pc.MetricsAddress, "address to serve prometheus metrics on ( disabled if empty )")
+	fs.StringVar(&pc.KeyID, "key-id", pc.KeyID, "id of the key used to authenticate on the isolator")
+	fs.StringVar(&pc.Secret, "secret", pc.Secret, "secret of the key used to authenticate on the isolator ( prefer PROXY_SECRET )")
+	fs.StringVar(&pc.TLSCA, "tls-ca", pc.TLSCA, "CA bundle to verify the isolator certificate ( system roots if empty )")
+	fs.StringVar(&pc.TLSCert, "tls-cert", pc.TLSCert, "client certificate to authenticate on the isolator")
+	fs.StringVar(&pc.TLSKey, "tls-key", pc.TLSKey, "client certificate private key")
+	fs.StringVar(&pc.PolicyFile, "policy-file", pc.PolicyFile, "JSON file of the rules allowing or denying destinations")
+	fs.BoolVar(&pc.DenyPrivate, "deny-private", pc.DenyPrivate, "deny loopback, private and link local destinations whatever the policy file rules")
+	fs.Var(&pc.DialTimeout, "dial-timeout", "default timeout of the connections to the destinations ( 0 = none )")
+	fs.Var(&pc.TLSHandshakeTimeout, "tls-handshake-timeout", "default timeout of the TLS handshakes with the destinations ( 0 = none )")
+	fs.Var(&pc.ResponseHeaderTimeout, "response-header-timeout", "default time to wait for the destinations response headers once the request is sent ( 0 = none )")
+	fs.Var(&pc.ClientTimeout, "client-timeout", "default total timeout of the requests to the destinations including the bodies ( 0 = none )")
+	fs.Var(&pc.MaxTimeout, "max-timeout", "maximum timeouts clients can ask for with the X-PROXY-TIMEOUT header")
+	fs.BoolVar(&pc.InsecureSkipVerify, "insecure-skip-verify", pc.InsecureSkipVerify, "do not verify the destinations TLS certificates")
+	fs.IntVar(&pc.MaxIdleConnsPerHost, "max-idle-conns-per-host", pc.MaxIdleConnsPerHost, "maximum idle keep-alive connections to each destination")
+	fs.BoolVar(&pc.FollowRedirects, "follow-redirects", pc.FollowRedirects, "follow the redirects returned by the destinations")
+}
+
+func (pc *ProxyConfig) Validate() error {
+	if pc.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if len(pc.Targets) == 0 {
+		return fmt.Errorf("At least one target is required")
+	}
+	for _, target := range pc.Targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("Invalid target %q : %s", target, err)
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return fmt.Errorf("Invalid target %q : scheme must be ws or wss", target)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("Invalid target %q : missing host", target)
+		}
+	}
+	if pc.PoolIdleSize <= 0 {
+		return fmt.Errorf("PoolIdleSize must be greater than 0")
+	}
+	if pc.PoolMaxSize < pc.PoolIdleSize {
+		return fmt.Errorf("PoolMaxSize must be greater than or equal to PoolIdleSize")
+	}
+	if (pc.KeyID == "") != (pc.Secret == "") {
+		return fmt.Errorf("Both KeyID and Secret are required to authenticate")
+	}
+	if (pc.TLSCert == "") != (pc.TLSKey == "") {
+		return fmt.Errorf("Both TLSCert and TLSKey are required to use a client certificate")
+	}
+	if pc.MaxStreams <= 0 {
+		return fmt.Errorf("MaxStreams must be greater than 0")
+	}
+	if pc.HeartbeatInterval < 0 || pc.HeartbeatTimeout < 0 {
+		return fmt.Errorf("Heartbeat durations must be positive")
+	}
+	if pc.HeartbeatInterval > 0 && pc.HeartbeatTimeout <= pc.HeartbeatInterval {
+		return fmt.Errorf("HeartbeatTimeout must be greater than HeartbeatInterval")
+	}
+	if pc.DialTimeout < 0 || pc.TLSHandshakeTimeout < 0 || pc.ResponseHeaderTimeout < 0 || pc.ClientTimeout < 0 {
+		return fmt.Errorf("Timeouts must be positive")
+	}
+	if pc.MaxTimeout <= 0 {
+		return fmt.Errorf("MaxTimeout must be greater than 0")
+	}
+	if pc.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("MaxIdleConnsPerHost must be positive")
+	}
+	return nil
+}
+
+// LoadProxyConfig loads the configuration from the command line arguments,
+// the PROXY_* environment variables and the file given by -config
+func LoadProxyConfig(args []string) (pc *ProxyConfig, err error) {
+	pc = NewProxyConfig()
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	fs.String("config", "", "configuration file ( JSON )")
+	pc.RegisterFlags(fs)
+
+	err = common.LoadConfig(pc, fs, args, "PROXY")
+	if err != nil {
+		return nil, err
+	}
+
+	err = pc.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration : %s", err)
+	}
+
+	return
+}
@@ -1,20 +1,25 @@
 package proxy
 
 import (
+	"context"
 	"log"
-	"encoding/json"
-	"github.com/gorilla/websocket"
+	"fmt"
 	"io"
 	"net/url"
 	"io/ioutil"
 	"github.com/root-gg/isolator/common"
 	"time"
 	"sync"
+	"strconv"
+	"net/http"
+	"github.com/gorilla/websocket"
 )
 
 const (
 	CONNECTING = iota
+	// The connection can accept more streams
 	IDLE
+	// The connection carries MaxStreams streams
 	RUNNING
 	CLOSED
 )
@@ -22,8 +27,11 @@ const (
 type ProxyConnection struct {
 	pool *ConnectionPool
 	ws *websocket.Conn
+	session *common.Session
 	last time.Time
 	status int
+	streams int
+	lock sync.Mutex
 }
 
 func NewProxyConnection(pool *ConnectionPool) (conn *ProxyConnection) {
@@ -36,18 +44,25 @@ func NewProxyConnection(pool *ConnectionPool) (conn *ProxyConnection) {
 func (conn *ProxyConnection) Connect() (err error){
 	log.Printf("Connecting to %s", conn.pool.target)
 
-	conn.ws, _, err = websocket.DefaultDialer.Dial(conn.pool.target, nil)
+	header := make(http.Header)
+	config := conn.pool.proxy.config
+	if config.KeyID != "" {
+		header.Set(common.RegisterTokenHeader, common.NewRegisterToken(config.KeyID, config.Secret, config.Name).String())
+		header.Set(common.RegisterNameHeader, config.Name)
+	}
+
+	conn.ws, _, err = conn.pool.proxy.dialer.Dial(conn.pool.target, header)
 	if err != nil {
 		return err
 	}
 
-	conn.ws.SetCloseHandler(func(mt int, err string) error{
-		log.Println("connection lost")
-		conn.pool.Remove(conn)
-		return nil
-	})
+	if conn.ws.Subprotocol() != common.Subprotocol {
+		conn.ws.Close()
+		return fmt.Errorf("Incompatible isolator, %s protocol is not supported", common.Subprotocol)
+	}
 
 	conn.last = time.Now()
+	connectionsOpenedTotal.WithLabelValues(conn.pool.target).Inc()
 
 	go conn.Serve()
 
@@ -59,131 +74,221 @@ func (conn *ProxyConnection) Serve() {
 	defer conn.Close()
 
 	// Greeting
-	err := conn.ws.WriteMessage(websocket.TextMessage, []byte(conn.pool.proxy.config.Name))
+	err := common.WriteGreeting(conn.ws, conn.pool.proxy.greeting)
 	if err != nil {
 		log.Println("greeting error :", err)
 		return
 	}
 
-	var wlock sync.Mutex
+	// The isolator opens a stream for each request
+	config := conn.pool.proxy.config
+	conn.lock.Lock()
+	conn.session = common.NewSession(conn.ws, conn.handle)
+	conn.session.Heartbeat(time.Duration(config.HeartbeatInterval), time.Duration(config.HeartbeatTimeout))
+	conn.status = IDLE
+	conn.lock.Unlock()
+
+	<-conn.session.Done()
+	log.Printf("connection lost : %s", conn.session.Err())
+	if conn.session.Err() == common.ErrDeadPeer {
+		connectionsDeadTotal.WithLabelValues(conn.pool.target).Inc()
+	}
+}
 
-	//go func(){
-	//	for {
-	//		time.Sleep(time.Second)
-	//		wlock.Lock()
-	//		err = conn.ws.WriteControl(websocket.PingMessage,[]byte("ping"), time.Now().Add(time.Second))
-	//		if err != nil {
-	//			conn.Close()
-	//		}
-	//		wlock.Unlock()
-	//	}
-	//}()
+// acquire accounts for a new stream, a new connection is opened if this one is saturated
+func (conn *ProxyConnection) acquire() {
+	conn.lock.Lock()
+	conn.streams++
+	conn.last = time.Now()
+	saturated := conn.streams >= conn.pool.proxy.config.MaxStreams && conn.status == IDLE
+	if saturated {
+		conn.status = RUNNING
+	}
+	conn.lock.Unlock()
 
-	for {
-		// Read request
-		conn.status = IDLE
-		_, jsonRequest, err := conn.ws.ReadMessage()
-		if err != nil {
-			log.Println("Unable to read request", err)
-			break
-		}
+	if saturated {
+		go conn.pool.Connect()
+	}
+}
 
-		log.Printf("got request : %s", jsonRequest)
+func (conn *ProxyConnection) release() {
+	conn.lock.Lock()
+	conn.streams--
+	if conn.status == RUNNING && conn.streams < conn.pool.proxy.config.MaxStreams {
+		conn.status = IDLE
+	}
+	conn.lock.Unlock()
+}
 
-		//if string(jsonRequest) == "ruok" {
-		//	err = conn.ws.WriteMessage(websocket.TextMessage,[]byte("imok"))
-		//	if err != nil {
-		//		log.Println("Unable respond to keepalive request", err)
-		//		break
-		//	}
-		//	continue
-		//}
+// Status returns the state of the connection ( CONNECTING, IDLE, RUNNING or CLOSED )
+func (conn *ProxyConnection) Status() int {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
 
-		conn.status = RUNNING
-		conn.last = time.Now()
-		go conn.pool.Connect()
+	return conn.status
+}
 
-		wlock.Lock()
+// handle executes the request of a stream opened by the isolator
+func (conn *ProxyConnection) handle(stream *common.Stream) {
+	conn.acquire()
+	defer conn.release()
 
-		// Unserialize request
-		httpRequest := new(common.HttpRequest)
-		err = json.Unmarshal(jsonRequest, httpRequest)
-		if err != nil {
-			log.Printf("Unable to unserialize http request : %s", err)
-			break
-		}
-		req := common.UnserializeHttpRequest(httpRequest)
+	// Read request
+	frame, err := stream.ReadFrame()
+	if err != nil {
+		log.Println("Unable to read request", err)
+		return
+	}
 
-		dstURL := httpRequest.Header.Get("X-PROXY-DESTINATION")
-		if dstURL == "" {
-			log.Println("Missing X-PROXY-DESTINATION header")
-			break
-		}
+	switch frame.Type {
+	case common.FrameRequest:
+		conn.handleRequest(stream, frame)
+	case common.FrameTunnel:
+		conn.handleTunnel(stream, frame)
+	default:
+		log.Printf("Unexpected frame type %d instead of http request", frame.Type)
+		stream.Reset()
+	}
+}
 
-		URL, err := url.Parse(dstURL)
-		if err != nil {
-			log.Printf("Unable to parse URL : %v", err)
-			break
-		}
-		req.URL = URL
+// handleRequest executes an http request and pipes the response back
+func (conn *ProxyConnection) handleRequest(stream *common.Stream, frame *common.Frame) {
+	// Unserialize request
+	httpRequest := new(common.HttpRequest)
+	err := httpRequest.UnmarshalBinary(frame.Payload)
+	if err != nil {
+		conn.fail(stream, common.ErrorBadRequest, fmt.Errorf("Unable to unserialize http request : %s", err))
+		return
+	}
+	req := common.UnserializeHttpRequest(httpRequest)
 
-		// Protect against trolls
-		//req.Header.Del("X-PROXY-DESTINATION")
+	dstURL := httpRequest.Header.Get("X-PROXY-DESTINATION")
+	if dstURL == "" {
+		conn.fail(stream, common.ErrorBadRequest, fmt.Errorf("Missing X-PROXY-DESTINATION header"))
+		return
+	}
 
-		// Pipe request body
-		_, bodyReader, err := conn.ws.NextReader()
-		if err != nil {
-			log.Printf("Unable to get response body reader : %v", err)
-			break
+	URL, err := url.Parse(dstURL)
+	if err != nil {
+		conn.fail(stream, common.ErrorBadRequest, fmt.Errorf("Unable to parse URL : %s", err))
+		return
+	}
+	req.URL = URL
+
+	// Protect against trolls
+	//req.Header.Del("X-PROXY-DESTINATION")
+
+	// Pipe request body
+	body := &countingReader{reader: stream}
+	req.Body = ioutil.NopCloser(body)
+
+	// Abort the request if the isolator cancels the stream or a timeout expires
+	timeouts := conn.pool.proxy.requestTimeouts(httpRequest.Timeouts)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if timeouts.Total > 0 {
+		var cancelTotal context.CancelFunc
+		ctx, cancelTotal = context.WithTimeout(ctx, timeouts.Total)
+		defer cancelTotal()
+	}
+	// ctx is wrapped below, the watcher keeps its own reference
+	done := ctx.Done()
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel(stream.Err())
+		case <-done:
 		}
-		req.Body = ioutil.NopCloser(bodyReader)
-
-		// Execute request
-		log.Printf("execute request")
-		resp, err := conn.pool.proxy.client.Do(req)
-		if err != nil {
-			log.Printf("Unable to execute request : %v", err)
-			break
+	}()
+	ctx, stopTimer := withTimeouts(ctx, timeouts, cancel)
+	req = req.WithContext(ctx)
+
+	// Execute request
+	log.Printf("execute request")
+	start := time.Now()
+	client := conn.pool.proxy.client
+	if httpRequest.NoRedirect {
+		client = conn.pool.proxy.noRedirectClient
+	}
+	resp, err := client.Do(req)
+	stopTimer()
+	bodyBytesTotal.WithLabelValues(conn.pool.target, "out").Add(float64(body.count))
+	if err != nil && stream.Err() == common.ErrStreamCanceled {
+		log.Printf("Request canceled by the isolator")
+		requestsTotal.WithLabelValues(conn.pool.target, "canceled").Inc()
+		return
+	}
+	if err != nil {
+		class := classifyError(err)
+		if context.Cause(ctx) == errResponseHeaderTimeout {
+			class = common.ErrorTimeout
+			err = errResponseHeaderTimeout
 		}
-
-		// Serialize response
-		jsonResponse, err := json.Marshal(common.SerializeHttpResponse(resp))
-		if err != nil {
-			log.Printf("Unable to serialize response : %v", err)
-			break
+		if body.err != nil && body.err != io.EOF {
+			class = common.ErrorBodyRead
 		}
+		conn.fail(stream, class, err)
+		return
+	}
+	defer resp.Body.Close()
+	upstreamLatency.WithLabelValues(conn.pool.target).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(conn.pool.target, strconv.Itoa(resp.StatusCode)).Inc()
 
-		log.Println("write response")
-
-		// Write response
-		err = conn.ws.WriteMessage(websocket.TextMessage,jsonResponse)
-		if err != nil {
-			log.Printf("Unable to write response : %v", err)
-			return
-			break
-		}
+	// The rest of the request body is not needed anymore
+	stream.CloseRead()
 
-		log.Println("write response body")
+	// Write serialized response
+	err = stream.WriteHead(common.FrameResponse,common.SerializeHttpResponse(resp))
+	if err != nil {
+		log.Printf("Unable to write response : %v", err)
+		stream.Reset()
+		return
+	}
 
-		// Pipe response body
-		bodyWriter, err := conn.ws.NextWriter(websocket.BinaryMessage)
-		if (err != nil){
-			log.Printf("Unable to get response body writer : %v",err)
-			break
-		}
-		_, err = io.Copy(bodyWriter,resp.Body)
-		if err != nil {
-			log.Printf("Unable to get pipe response body : %v",err)
-			break
-		}
-		bodyWriter.Close()
+	// Pipe response body
+	n, err := io.Copy(stream,resp.Body)
+	bodyBytesTotal.WithLabelValues(conn.pool.target, "in").Add(float64(n))
+	if err != nil && stream.Err() == common.ErrStreamCanceled {
+		log.Printf("Request canceled by the isolator while piping response body")
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get pipe response body : %v",err)
+		stream.Reset()
+		return
+	}
 
-		wlock.Unlock()
+	err = stream.CloseWrite()
+	if err != nil {
+		log.Printf("Unable to end response body : %v",err)
+		stream.Reset()
 	}
 }
 
 func (conn *ProxyConnection) Close() {
 	defer conn.pool.Remove(conn)
+
+	conn.lock.Lock()
 	conn.status = CLOSED
+	conn.lock.Unlock()
+
 	conn.ws.Close()
+	connectionsClosedTotal.WithLabelValues(conn.pool.target).Inc()
+}
+
+// countingReader counts the bytes read from the underlying reader
+// and keeps the last read error
+type countingReader struct {
+	reader io.Reader
+	count int64
+	err error
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.reader.Read(p)
+	cr.count += int64(n)
+	if err != nil {
+		cr.err = err
+	}
+	return
 }
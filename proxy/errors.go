@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// classifyError returns the error class of a failed request execution
+func classifyError(err error) string {
+	var dnsError *net.DNSError
+	var netError net.Error
+	var opError *net.OpError
+	var policyError *PolicyError
+
+	switch {
+	case errors.As(err, &policyError):
+		return common.ErrorPolicyDenied
+	case errors.As(err, &dnsError):
+		return common.ErrorDNS
+	case errors.As(err, &netError) && netError.Timeout():
+		return common.ErrorTimeout
+	case isTLSError(err):
+		return common.ErrorTLS
+	case errors.As(err, &opError) && opError.Op == "dial":
+		return common.ErrorConnect
+	}
+	return common.ErrorUnknown
+}
+
+func isTLSError(err error) bool {
+	var recordHeaderError tls.RecordHeaderError
+	var alertError tls.AlertError
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+
+	if errors.As(err, &recordHeaderError) ||
+		errors.As(err, &alertError) ||
+		errors.As(err, &verificationError) ||
+		errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &hostnameError) ||
+		errors.As(err, &certificateInvalidError) {
+		return true
+	}
+
+	// Some handshake failures are only reported as text by crypto/tls and net/http
+	message := err.Error()
+	return strings.Contains(message, "tls: ") || strings.Contains(message, "HTTP response to HTTPS client")
+}
+
+// fail sends the error to the isolator instead of a response and aborts the stream
+func (conn *ProxyConnection) fail(stream *common.Stream, class string, err error) {
+	log.Printf("Unable to execute request ( %s ) : %s", class, err)
+	requestsTotal.WithLabelValues(conn.pool.target, "error").Inc()
+
+	e := stream.WriteHead(common.FrameError, common.NewProxyError(class, err.Error()))
+	if e != nil && e != io.EOF {
+		log.Printf("Unable to send error : %s", e)
+	}
+	stream.Reset()
+}
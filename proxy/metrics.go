@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proxy",
+		Name:      "requests_total",
+		Help:      "Number of requests executed by target and status code.",
+	}, []string{"target", "code"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "proxy",
+		Name:      "upstream_latency_seconds",
+		Help:      "Time spent waiting for the destination response headers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"target"})
+
+	bodyBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proxy",
+		Name:      "body_bytes_total",
+		Help:      "Number of body bytes piped by target and direction ( in = response, out = request ).",
+	}, []string{"target", "direction"})
+
+	connectionsOpenedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proxy",
+		Name:      "connections_opened_total",
+		Help:      "Number of websocket connections opened to the isolator.",
+	}, []string{"target"})
+
+	connectionsClosedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proxy",
+		Name:      "connections_closed_total",
+		Help:      "Number of websocket connections closed.",
+	}, []string{"target"})
+
+	connectionsDeadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proxy",
+		Name:      "connections_dead_total",
+		Help:      "Number of websocket connections closed because the isolator did not answer the heartbeat.",
+	}, []string{"target"})
+
+	poolConnectionsDesc = prometheus.NewDesc(
+		"proxy_pool_connections",
+		"Number of websocket connections by target and status.",
+		[]string{"target", "status"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(upstreamLatency)
+	prometheus.MustRegister(bodyBytesTotal)
+	prometheus.MustRegister(connectionsOpenedTotal)
+	prometheus.MustRegister(connectionsClosedTotal)
+	prometheus.MustRegister(connectionsDeadTotal)
+}
+
+// Describe implements prometheus.Collector
+func (p *Proxy) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+}
+
+// Collect implements prometheus.Collector, pool gauges are computed from PoolSize at scrape time
+func (p *Proxy) Collect(ch chan<- prometheus.Metric) {
+	for target, pool := range p.pools {
+		ps := pool.Size()
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(ps.connecting), target, "connecting")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(ps.idle), target, "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(ps.running), target, "running")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(ps.closed), target, "closed")
+	}
+}
+
+// serveMetrics exposes the prometheus metrics on the configured address
+func (p *Proxy) serveMetrics() {
+	prometheus.MustRegister(p)
+
+	r := http.NewServeMux()
+	r.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("Serving metrics on %s", p.config.MetricsAddress)
+	err := http.ListenAndServe(p.config.MetricsAddress, r)
+	if err != nil {
+		log.Printf("Unable to serve metrics : %s", err)
+	}
+}
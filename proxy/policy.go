@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Address ranges denied when ProxyConfig.DenyPrivate is set : loopback, RFC1918,
+// link local ( cloud metadata ), carrier grade NAT, unique local and unspecified addresses
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// PolicyRule allows or denies the destinations it matches,
+// empty fields match any destination
+type PolicyRule struct {
+	// allow or deny
+	Action string
+
+	// http, https or tcp for CONNECT tunnels
+	Schemes []string
+	// Host name globs ( ex : *.example.com )
+	Hosts []string
+	// Ports or port ranges ( ex : 443, 8000-8999 )
+	Ports []string
+	// Ranges of the resolved addresses ( ex : 10.0.0.0/8 )
+	CIDRs []string
+
+	ports    [][2]int
+	networks []*net.IPNet
+}
+
+// Policy decides which destinations the proxy can connect to. The first matching
+// rule applies, the default action applies if no rule matches.
+//
+// The policy is checked at dial time against every resolved address of the
+// destination, the connection is then made to an allowed address so that
+// DNS rebinding can't be used to reach a denied one.
+type Policy struct {
+	// allow or deny, defaults to allow
+	Default string
+	Rules   []*PolicyRule
+
+	// Private addresses are denied whatever the rules, set by LoadPolicy
+	private []*net.IPNet
+}
+
+// PolicyError is returned when a destination is denied by the policy
+type PolicyError struct {
+	Destination string
+	Reason      string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("Destination %s denied by policy %s", e.Destination, e.Reason)
+}
+
+// LoadPolicy reads a JSON Policy file, every resolved address is also
+// checked against the private ranges if denyPrivate is set
+func LoadPolicy(file string, denyPrivate bool) (policy *Policy, err error) {
+	policy = new(Policy)
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read policy file : %s", err)
+		}
+		err = json.Unmarshal(data, policy)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse policy file %s : %s", file, err)
+		}
+	}
+
+	err = policy.compile()
+	if err == nil && denyPrivate {
+		err = policy.denyPrivate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid policy : %s", err)
+	}
+	return
+}
+
+func (policy *Policy) compile() error {
+	if policy.Default == "" {
+		policy.Default = "allow"
+	}
+	if policy.Default != "allow" && policy.Default != "deny" {
+		return fmt.Errorf("invalid default action %q", policy.Default)
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fmt.Errorf("rule %d : invalid action %q", i, rule.Action)
+		}
+
+		for _, value := range rule.Ports {
+			bounds := strings.SplitN(value, "-", 2)
+			low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+			high := low
+			if err == nil && len(bounds) == 2 {
+				high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			}
+			if err != nil || low < 0 || high > 65535 || low > high {
+				return fmt.Errorf("rule %d : invalid port %q", i, value)
+			}
+			rule.ports = append(rule.ports, [2]int{low, high})
+		}
+
+		for _, value := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return fmt.Errorf("rule %d : invalid CIDR %q", i, value)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+
+		for _, pattern := range rule.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d : invalid host pattern %q", i, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rule *PolicyRule) matches(scheme string, host string, port int, ip net.IP) bool {
+	if len(rule.Schemes) > 0 {
+		match := false
+		for _, s := range rule.Schemes {
+			if strings.EqualFold(s, scheme) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	if len(rule.Hosts) > 0 {
+		match := false
+		for _, pattern := range rule.Hosts {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); ok {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	if len(rule.ports) > 0 {
+		match := false
+		for _, bounds := range rule.ports {
+			if port >= bounds[0] && port <= bounds[1] {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	if len(rule.networks) > 0 {
+		match := false
+		for _, network := range rule.networks {
+			if network.Contains(ip) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	return true
+}
+
+// evaluate returns the action of the first rule matching the destination, ip is nil if
+// the host has not been resolved yet, decided is then false if a rule depends on the address
+func (policy *Policy) evaluate(scheme string, host string, port int, ip net.IP) (action string, reason string, decided bool) {
+	for i, rule := range policy.Rules {
+		if ip == nil && len(rule.networks) > 0 {
+			return "", "", false
+		}
+		if rule.matches(scheme, host, port, ip) {
+			return rule.Action, fmt.Sprintf("rule %d", i), true
+		}
+	}
+	return policy.Default, "default", true
+}
+
+func (policy *Policy) deny(host string, port int, ip net.IP, reason string) error {
+	destination := net.JoinHostPort(host, strconv.Itoa(port))
+	if ip != nil && ip.String() != host {
+		destination += " ( " + ip.String() + " )"
+	}
+	return &PolicyError{Destination: destination, Reason: reason}
+}
+
+// denyPrivate denies the private ranges before any rule
+func (policy *Policy) denyPrivate() error {
+	policy.private = nil
+	for _, value := range privateCIDRs {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid private CIDR %q", value)
+		}
+		policy.private = append(policy.private, network)
+	}
+	return nil
+}
+
+// checkPrivate returns a PolicyError if ip is in a denied private range
+func (policy *Policy) checkPrivate(host string, port int, ip net.IP) error {
+	if ip == nil {
+		return nil
+	}
+	for _, network := range policy.private {
+		if network.Contains(ip) {
+			return policy.deny(host, port, ip, "private address")
+		}
+	}
+	return nil
+}
+
+// Check returns a PolicyError if the destination is denied
+func (policy *Policy) Check(scheme string, host string, port int, ip net.IP) error {
+	if err := policy.checkPrivate(host, port, ip); err != nil {
+		return err
+	}
+	action, reason, _ := policy.evaluate(scheme, host, port, ip)
+	if action == "deny" {
+		return policy.deny(host, port, ip, reason)
+	}
+	return nil
+}
+
+// Resolve returns the addresses of host the policy allows to connect to. The
+// rules that do not depend on the address are checked before resolving the host,
+// the resolved addresses are always checked against the private ranges.
+func (policy *Policy) Resolve(ctx context.Context, scheme string, host string, port int) (ips []net.IP, err error) {
+	action, reason, decided := policy.evaluate(scheme, host, port, nil)
+	if decided && action == "deny" {
+		return nil, policy.deny(host, port, nil, reason)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if decided {
+			err = policy.checkPrivate(host, port, addr.IP)
+		} else {
+			err = policy.Check(scheme, host, port, addr.IP)
+		}
+		if err == nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	// Report the denial of the last address if none is allowed
+	if len(ips) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+	return ips, nil
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func newTestPolicy(t *testing.T, policy *Policy, denyPrivate bool) *Policy {
+	err := policy.compile()
+	if err == nil && denyPrivate {
+		err = policy.denyPrivate()
+	}
+	if err != nil {
+		t.Fatalf("Unable to compile policy : %s", err)
+	}
+	return policy
+}
+
+func TestPolicyCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		valid  bool
+	}{
+		{"empty", &Policy{}, true},
+		{"deny default", &Policy{Default: "deny"}, true},
+		{"invalid default", &Policy{Default: "drop"}, false},
+		{"invalid action", &Policy{Rules: []*PolicyRule{{Action: "drop"}}}, false},
+		{"port", &Policy{Rules: []*PolicyRule{{Action: "allow", Ports: []string{"443"}}}}, true},
+		{"port range", &Policy{Rules: []*PolicyRule{{Action: "allow", Ports: []string{"8000-8999"}}}}, true},
+		{"inverted port range", &Policy{Rules: []*PolicyRule{{Action: "allow", Ports: []string{"9000-8000"}}}}, false},
+		{"port out of range", &Policy{Rules: []*PolicyRule{{Action: "allow", Ports: []string{"65536"}}}}, false},
+		{"invalid port", &Policy{Rules: []*PolicyRule{{Action: "allow", Ports: []string{"https"}}}}, false},
+		{"cidr", &Policy{Rules: []*PolicyRule{{Action: "deny", CIDRs: []string{"10.0.0.0/8", "fc00::/7"}}}}, true},
+		{"invalid cidr", &Policy{Rules: []*PolicyRule{{Action: "deny", CIDRs: []string{"10.0.0.0"}}}}, false},
+		{"invalid host pattern", &Policy{Rules: []*PolicyRule{{Action: "deny", Hosts: []string{"[a-"}}}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.policy.compile()
+		if test.valid && err != nil {
+			t.Errorf("%s : unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s : expected an error", test.name)
+		}
+	}
+}
+
+func TestPrivateCIDRs(t *testing.T) {
+	policy := newTestPolicy(t, &Policy{}, true)
+
+	tests := []struct {
+		ip     string
+		denied bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		// IPv4-mapped IPv6 addresses are matched as IPv4
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:8.8.8.8", false},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		err := policy.Check("http", test.ip, 80, ip)
+		if test.denied && err == nil {
+			t.Errorf("%s should be denied", test.ip)
+		}
+		if !test.denied && err != nil {
+			t.Errorf("%s should be allowed : %s", test.ip, err)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := newTestPolicy(t, &Policy{
+		Default: "deny",
+		Rules: []*PolicyRule{
+			{Action: "deny", Hosts: []string{"*.internal.example.com"}},
+			{Action: "allow", Schemes: []string{"https"}, Hosts: []string{"*.example.com"}, Ports: []string{"443", "8000-8999"}},
+			{Action: "allow", Schemes: []string{"tcp"}, Ports: []string{"22"}, CIDRs: []string{"192.0.2.0/24"}},
+		},
+	}, false)
+
+	tests := []struct {
+		name    string
+		scheme  string
+		host    string
+		port    int
+		ip      string
+		action  string
+		decided bool
+	}{
+		{"denied host", "https", "db.internal.example.com", 443, "", "deny", true},
+		{"allowed host", "https", "www.example.com", 443, "", "allow", true},
+		{"host glob is case insensitive", "https", "WWW.Example.COM", 443, "", "allow", true},
+		{"port range low bound", "https", "www.example.com", 8000, "", "allow", true},
+		{"port range high bound", "https", "www.example.com", 8999, "", "allow", true},
+		{"port out of range", "https", "www.example.com", 9000, "", "", false},
+		{"wrong scheme", "http", "www.example.com", 443, "", "", false},
+		{"cidr rule needs the address", "tcp", "bastion", 22, "", "", false},
+		{"cidr rule match", "tcp", "bastion", 22, "192.0.2.10", "allow", true},
+		{"cidr rule mismatch", "tcp", "bastion", 22, "198.51.100.10", "deny", true},
+	}
+
+	for _, test := range tests {
+		var ip net.IP
+		if test.ip != "" {
+			ip = net.ParseIP(test.ip)
+		}
+		action, _, decided := policy.evaluate(test.scheme, test.host, test.port, ip)
+		if decided != test.decided || action != test.action {
+			t.Errorf("%s : got %q ( decided %v ), expected %q ( decided %v )", test.name, action, decided, test.action, test.decided)
+		}
+	}
+}
+
+func TestPolicyResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *Policy
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"private literal", &Policy{}, "127.0.0.1", 80, false},
+		{"metadata literal", &Policy{}, "169.254.169.254", 80, false},
+		{"mapped metadata literal", &Policy{}, "::ffff:169.254.169.254", 80, false},
+		{"private name", &Policy{}, "localhost", 80, false},
+		{"public literal", &Policy{}, "8.8.8.8", 53, true},
+		// Allowing a host does not allow it to resolve to a private address
+		{"host allowed resolving to a private address", &Policy{Rules: []*PolicyRule{
+			{Action: "allow", Hosts: []string{"local*"}},
+		}}, "localhost", 80, false},
+		{"private range allowed by a rule", &Policy{Rules: []*PolicyRule{
+			{Action: "allow", CIDRs: []string{"127.0.0.0/8"}},
+		}}, "localhost", 80, false},
+		{"host allowed on another port", &Policy{Rules: []*PolicyRule{
+			{Action: "allow", Hosts: []string{"local*"}, Ports: []string{"8000-8999"}},
+		}}, "localhost", 80, false},
+		{"host allowed in the port range", &Policy{Rules: []*PolicyRule{
+			{Action: "allow", Hosts: []string{"local*"}, Ports: []string{"8000-8999"}},
+		}}, "localhost", 8080, false},
+		{"public literal allowed in the port range", &Policy{Rules: []*PolicyRule{
+			{Action: "allow", Hosts: []string{"8.8.*"}, Ports: []string{"8000-8999"}},
+		}}, "8.8.8.8", 8080, true},
+		{"host denied before resolving", &Policy{Rules: []*PolicyRule{
+			{Action: "deny", Hosts: []string{"*.invalid"}},
+		}}, "nowhere.invalid", 80, false},
+	}
+
+	for _, test := range tests {
+		policy := newTestPolicy(t, test.policy, true)
+		ips, err := policy.Resolve(context.Background(), "http", test.host, test.port)
+		if test.allowed && (err != nil || len(ips) == 0) {
+			t.Errorf("%s : %s should be allowed : %v", test.name, test.host, err)
+		}
+		if !test.allowed {
+			if err == nil {
+				t.Errorf("%s : %s should be denied, got %v", test.name, test.host, ips)
+			} else if _, ok := err.(*PolicyError); !ok {
+				t.Errorf("%s : expected a PolicyError, got %s", test.name, err)
+			}
+		}
+	}
+}
@@ -115,7 +115,7 @@ func (cp *ConnectionPool) Size() (ps *PoolSize){
 	ps = new(PoolSize)
 	ps.total = len(cp.connections)
 	for _, connection :=  range cp.connections {
-		switch connection.status {
+		switch connection.Status() {
 		case CONNECTING:
 			ps.connecting++
 		case IDLE:
@@ -155,7 +155,13 @@ func (cp *ConnectionPool) Remove(conn *ProxyConnection){
 
 func (cp *ConnectionPool) Shutdown(){
 	close(cp.done)
-	for _, conn := range cp.connections {
+
+	// Close removes the connection from the pool, iterate over a copy
+	cp.lock.Lock()
+	connections := append([]*ProxyConnection(nil), cp.connections...)
+	cp.lock.Unlock()
+
+	for _, conn := range connections {
 		conn.Close()
 	}
 }
\ No newline at end of file
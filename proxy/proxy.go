@@ -1,19 +1,65 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nu7hatch/gouuid"
+	"github.com/root-gg/isolator/common"
 )
 
+// Version of the proxy agent advertised to the isolator
+const Version = "0.2.0"
+
 type Proxy struct {
 	config *ProxyConfig
 	client *http.Client
+	// Same transport as client, redirects are returned to the isolator
+	noRedirectClient *http.Client
+	tlsConfig *tls.Config
+	policy *Policy
+	dialer *websocket.Dialer
+	greeting *common.Greeting
 	pools map[string]*ConnectionPool
 }
 
-func NewProxy(config *ProxyConfig) (p *Proxy){
+func NewProxy(config *ProxyConfig) (p *Proxy, err error){
 	p = new(Proxy)
 	p.config = config
-	p.client = new(http.Client)
+	p.policy, err = LoadPolicy(config.PolicyFile, config.DenyPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	p.tlsConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	p.client = p.newHttpClient()
+	p.noRedirectClient = new(http.Client)
+	p.noRedirectClient.Transport = p.client.Transport
+	p.noRedirectClient.CheckRedirect = noRedirect
+	p.dialer, err = newDialer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceID, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate instance id : %s", err)
+	}
+
+	greeting := new(common.Greeting)
+	p.greeting = greeting
+	greeting.Version = common.GreetingVersion
+	greeting.Name = config.Name
+	greeting.InstanceID = instanceID.String()
+	greeting.AgentVersion = Version
+	greeting.Labels = config.Labels
+	greeting.Capabilities = []string{"http", "mux", "tunnel"}
+	greeting.Capacity = config.PoolMaxSize * config.MaxStreams
+	greeting.MaxStreams = config.MaxStreams
+
 	p.pools = make(map[string]*ConnectionPool)
 	return
 }
@@ -24,10 +70,72 @@ func (p *Proxy) Start() {
 		p.pools[target] = pool
 		go pool.Start()
 	}
+
+	if p.config.MetricsAddress != "" {
+		go p.serveMetrics()
+	}
 }
 
 func (p *Proxy) Shutdown() {
 	for _, pool := range p.pools {
 		pool.Shutdown()
 	}
-}
\ No newline at end of file
+}
+
+// newHttpClient creates the client of the destinations, the timeouts
+// are enforced per request ( see timeouts.go )
+func (p *Proxy) newHttpClient() (client *http.Client) {
+	config := p.config
+
+	// Same defaults as http.DefaultTransport except the environment proxy : the
+	// policy is checked on the dialed address, it must be the destination one
+	transport := new(http.Transport)
+	transport.DialContext = p.dialContext
+	transport.DialTLSContext = p.dialTLSContext
+	transport.TLSHandshakeTimeout = time.Duration(config.TLSHandshakeTimeout)
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSClientConfig = p.tlsConfig
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+
+	client = new(http.Client)
+	client.Transport = transport
+	if !config.FollowRedirects {
+		client.CheckRedirect = noRedirect
+	}
+	return
+}
+
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// Maximum duration of the websocket handshake with the isolator
+const handshakeTimeout = 45 * time.Second
+
+// newDialer configures the TLS settings of the connections to the isolator
+func newDialer(config *ProxyConfig) (dialer *websocket.Dialer, err error) {
+	tlsConfig := new(tls.Config)
+
+	if config.TLSCA != "" {
+		tlsConfig.RootCAs, err = common.LoadCertPool(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate : %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer = new(websocket.Dialer)
+	dialer.Proxy = http.ProxyFromEnvironment
+	// A stalled isolator must not hang the connection forever
+	dialer.HandshakeTimeout = handshakeTimeout
+	dialer.Subprotocols = []string{common.Subprotocol}
+	dialer.TLSClientConfig = tlsConfig
+	return
+}
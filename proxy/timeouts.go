@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+type timeoutsKey struct{}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// requestTimeouts completes the timeouts asked by the client with the configured ones,
+// the client ones are capped to MaxTimeout
+func (p *Proxy) requestTimeouts(t common.Timeouts) common.Timeouts {
+	max := time.Duration(p.config.MaxTimeout)
+	for _, timeout := range []*time.Duration{&t.Dial, &t.TLSHandshake, &t.ResponseHeader, &t.Total} {
+		if *timeout > max {
+			*timeout = max
+		}
+	}
+
+	if t.Dial == 0 {
+		t.Dial = time.Duration(p.config.DialTimeout)
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSHandshake = time.Duration(p.config.TLSHandshakeTimeout)
+	}
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = time.Duration(p.config.ResponseHeaderTimeout)
+	}
+	if t.Total == 0 {
+		t.Total = time.Duration(p.config.ClientTimeout)
+	}
+	return t
+}
+
+// timeoutsFromContext returns the timeouts of the request being dialed
+func (p *Proxy) timeoutsFromContext(ctx context.Context) common.Timeouts {
+	if t, ok := ctx.Value(timeoutsKey{}).(common.Timeouts); ok {
+		return t
+	}
+	return p.requestTimeouts(common.Timeouts{})
+}
+
+// dialContext opens the connections to the destinations with the dial timeout of the request
+func (p *Proxy) dialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return p.dial(ctx, "http", network, address)
+}
+
+// dial connects to an address allowed by the policy
+func (p *Proxy) dial(ctx context.Context, scheme string, network string, address string) (conn net.Conn, err error) {
+	if timeout := p.timeoutsFromContext(ctx).Dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %q", portString)
+	}
+
+	ips, err := p.policy.Resolve(ctx, scheme, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), portString))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialTLSContext opens the TLS connections to the destinations with
+// the dial and handshake timeouts of the request
+func (p *Proxy) dialTLSContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := p.dial(ctx, "https", network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := p.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	if timeout := p.timeoutsFromContext(ctx).TLSHandshake; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// withTimeouts binds the timeouts to the request context, cancel is called
+// with errResponseHeaderTimeout if the response headers take too long.
+// The returned stop function must be called once the response headers are received.
+func withTimeouts(ctx context.Context, t common.Timeouts, cancel context.CancelCauseFunc) (context.Context, func()) {
+	ctx = context.WithValue(ctx, timeoutsKey{}, t)
+	if t.ResponseHeader <= 0 {
+		return ctx, func() {}
+	}
+
+	// Like http.Transport.ResponseHeaderTimeout the timer starts once the
+	// request has been written, for each redirect
+	var lock sync.Mutex
+	var timer *time.Timer
+	responded := false
+	stop := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			stop()
+			lock.Lock()
+			responded = false
+			lock.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			lock.Lock()
+			defer lock.Unlock()
+			if !responded && timer == nil {
+				timer = time.AfterFunc(t.ResponseHeader, func() { cancel(errResponseHeaderTimeout) })
+			}
+		},
+		GotFirstResponseByte: func() {
+			stop()
+			lock.Lock()
+			responded = true
+			lock.Unlock()
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), stop
+}
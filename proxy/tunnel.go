@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/root-gg/isolator/common"
+)
+
+// handleTunnel opens a raw TCP connection to the destination of a CONNECT
+// request and relays the bytes between the stream and the connection
+func (conn *ProxyConnection) handleTunnel(stream *common.Stream, frame *common.Frame) {
+	tunnelRequest := new(common.TunnelRequest)
+	err := tunnelRequest.UnmarshalBinary(frame.Payload)
+	if err != nil {
+		conn.fail(stream, common.ErrorBadRequest, fmt.Errorf("Unable to unserialize tunnel request : %s", err))
+		return
+	}
+
+	timeouts := conn.pool.proxy.requestTimeouts(tunnelRequest.Timeouts)
+	if tunnelRequest.Timeouts.Total == 0 {
+		// ClientTimeout bounds the requests, tunnels are long lived
+		// unless the client asks for a total timeout
+		timeouts.Total = 0
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), timeoutsKey{}, timeouts))
+	defer cancel()
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// The destination policy is checked at dial time
+	log.Printf("open tunnel to %s", tunnelRequest.Address)
+	tcpConn, err := conn.pool.proxy.dial(ctx, "tcp", "tcp", tunnelRequest.Address)
+	if err != nil {
+		if stream.Err() == common.ErrStreamCanceled {
+			log.Printf("Tunnel canceled by the isolator")
+			requestsTotal.WithLabelValues(conn.pool.target, "canceled").Inc()
+			return
+		}
+		conn.fail(stream, classifyError(err), err)
+		return
+	}
+	defer tcpConn.Close()
+
+	err = stream.WriteFrame(common.FrameTunnel, nil)
+	if err != nil {
+		log.Printf("Unable to acknowledge tunnel : %v", err)
+		stream.Reset()
+		return
+	}
+	requestsTotal.WithLabelValues(conn.pool.target, "tunnel").Inc()
+
+	// Abort the tunnel once the total timeout expires
+	if timeouts.Total > 0 {
+		timer := time.AfterFunc(timeouts.Total, func() {
+			log.Printf("Tunnel to %s timed out", tunnelRequest.Address)
+			stream.Reset()
+			tcpConn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	in, out := common.Relay(stream, tcpConn)
+	bodyBytesTotal.WithLabelValues(conn.pool.target, "in").Add(float64(in))
+	bodyBytesTotal.WithLabelValues(conn.pool.target, "out").Add(float64(out))
+}